@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+const benchDocs = 1000
+
+// benchTime is how long the bench command runs each measurement, go test
+// -bench runs the same code through BenchmarkBulkBody.
+const benchTime = time.Second
+
+// benchMessages generates benchDocs levels and messages from the templates.
+func benchMessages(config *Config, logTemplates [][][]string) ([]string, []string) {
+	r := rand.New(rand.NewSource(1))
+	levels := make([]string, benchDocs)
+	msgs := make([]string, benchDocs)
+	for i := range msgs {
+		logTemplate := logTemplates[r.Intn(len(logTemplates))]
+		_, levels[i], msgs[i] = generateLogLevelMsg(config.Tags, config.TimeFormat, r, logTemplate[r.Intn(len(logTemplate))])
+	}
+	return levels, msgs
+}
+
+// encodeBulk encodes the documents into body, streams it through the
+// compression and returns the size of the uncompressed body.
+func encodeBulk(config *Config, compression string, levels, msgs []string, body *bulkBody) int {
+	body.reset()
+	for j := range msgs {
+		generateESLog(config, levels[j], msgs[j], body)
+	}
+	reader, _, wait := compressStream(compression, body.buf)
+	io.Copy(ioutil.Discard, reader)
+	wait()
+	return len(body.buf)
+}
+
+// measurement is the cost of one call of a measured function.
+type measurement struct {
+	n        int
+	nsPerOp  int64
+	bytes    uint64
+	allocs   uint64
+	bodySize int
+}
+
+func (m measurement) String() string {
+	mbPerSec := 0.0
+	if m.nsPerOp > 0 {
+		mbPerSec = float64(m.bodySize) * 1e3 / float64(m.nsPerOp)
+	}
+	return fmt.Sprintf("%8d %12d ns/op %8.2f MB/s %10d B/op %8d allocs/op", m.n, m.nsPerOp, mbPerSec, m.bytes, m.allocs)
+}
+
+// measure calls f until benchTime has passed and returns its cost per call.
+// f returns the number of bytes it produced.
+func measure(f func() int) measurement {
+	f()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	m := measurement{}
+	for time.Since(start) < benchTime {
+		m.bodySize = f()
+		m.n++
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	m.nsPerOp = elapsed.Nanoseconds() / int64(m.n)
+	m.bytes = (after.TotalAlloc - before.TotalAlloc) / uint64(m.n)
+	m.allocs = (after.Mallocs - before.Mallocs) / uint64(m.n)
+	return m
+}
+
+// runBulkBenchmark measures encoding a bulk body of benchDocs documents from
+// the loaded templates, plain and gzip streamed, and prints allocs/op.
+func runBulkBenchmark(config *Config, logTemplates [][][]string) {
+	levels, msgs := benchMessages(config, logTemplates)
+	for _, compression := range []string{"none", "gzip"} {
+		body := getBulkBody()
+		m := measure(func() int {
+			return encodeBulk(config, compression, levels, msgs, body)
+		})
+		putBulkBody(body)
+		fmt.Printf("bulk of %d docs, compression %s: %s\n", benchDocs, compression, m)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+// BenchmarkBulkBody measures encoding a bulk body of benchDocs documents
+// from the example templates, plain and gzip streamed, run with go test
+// -bench BulkBody -benchmem.
+func BenchmarkBulkBody(b *testing.B) {
+	gens, err := loadGenerators([]string{"config.json", "logTemp1", "logTemp2", "logTemp3"}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	config := gens[0].config
+	levels, msgs := benchMessages(config, gens[0].logTemplates)
+
+	for _, compression := range []string{"none", "gzip"} {
+		b.Run(compression, func(b *testing.B) {
+			b.ReportAllocs()
+			body := getBulkBody()
+			defer putBulkBody(body)
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = encodeBulk(config, compression, levels, msgs, body)
+			}
+			b.SetBytes(int64(size))
+		})
+	}
+}
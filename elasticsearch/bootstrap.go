@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// BootstrapConfig describes the index template, and optionally the ILM
+// policy, installed before any logs are sent so every run starts from a
+// known mapping.
+type BootstrapConfig struct {
+	TemplateName  string            `json:"template_name"`
+	IndexPatterns []string          `json:"index_patterns"`
+	Priority      int               `json:"priority"`
+	Shards        int               `json:"shards"`
+	Replicas      *int              `json:"replicas"`
+	FieldTypes    map[string]string `json:"field_types"`
+	ILMPolicy     string            `json:"ilm_policy"`
+	RolloverSize  string            `json:"rollover_max_size"`
+	RolloverAge   string            `json:"rollover_max_age"`
+	DeleteAfter   string            `json:"delete_after"`
+}
+
+var datePattern = regexp.MustCompile(`%[YymdHM]`)
+
+// indexPatterns returns the configured patterns or derives one from
+// index_name, replacing everything from the first date pattern with "*".
+func (b *BootstrapConfig) indexPatterns(config *Config) []string {
+	if len(b.IndexPatterns) > 0 {
+		return b.IndexPatterns
+	}
+	if config.IndexName == "" {
+		return nil
+	}
+	if loc := datePattern.FindStringIndex(config.IndexName); loc != nil {
+		return []string{strings.ToLower(config.IndexName[:loc[0]]) + "*"}
+	}
+	return []string{strings.ToLower(config.IndexName)}
+}
+
+// templateMappings builds the mapping of the fields the generator writes:
+// tags and level as keyword, message as text and time as epoch millis date.
+// field_types overrides the type of any field.
+func templateMappings(config *Config) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for tag := range config.Tags {
+		properties[tag] = map[string]interface{}{"type": "keyword"}
+	}
+	properties["level"] = map[string]interface{}{"type": "keyword"}
+	properties["message"] = map[string]interface{}{"type": "text"}
+	properties["time"] = map[string]interface{}{"type": "date", "format": "epoch_millis"}
+	if config.DataStream {
+		properties["@timestamp"] = map[string]interface{}{"type": "date", "format": "epoch_millis"}
+	}
+
+	for field, fieldType := range config.Bootstrap.FieldTypes {
+		properties[field] = map[string]interface{}{"type": fieldType}
+	}
+
+	return map[string]interface{}{"properties": properties}
+}
+
+func ilmPolicy(b *BootstrapConfig) map[string]interface{} {
+	rollover := make(map[string]interface{})
+	if b.RolloverSize != "" {
+		rollover["max_primary_shard_size"] = b.RolloverSize
+	}
+	if b.RolloverAge != "" {
+		rollover["max_age"] = b.RolloverAge
+	}
+
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{
+			"actions": map[string]interface{}{"rollover": rollover},
+		},
+	}
+	if b.DeleteAfter != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": b.DeleteAfter,
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+
+	return map[string]interface{}{"policy": map[string]interface{}{"phases": phases}}
+}
+
+// bootstrapElasticSearch installs the ILM policy, a component template with
+// the generator mappings and an index template composed of it.
+func bootstrapElasticSearch(config *Config, esConfig *ESTarget) error {
+	b := config.Bootstrap
+
+	patterns := b.indexPatterns(config)
+	if len(patterns) == 0 {
+		return errors.New("bootstrap needs index_patterns when index_name is not set")
+	}
+
+	settings := make(map[string]interface{})
+	if b.Shards > 0 {
+		settings["number_of_shards"] = b.Shards
+	}
+	if b.Replicas != nil {
+		settings["number_of_replicas"] = *b.Replicas
+	}
+
+	if b.ILMPolicy != "" {
+		if b.RolloverSize == "" && b.RolloverAge == "" {
+			return errors.New("ilm_policy needs rollover_max_size or rollover_max_age")
+		}
+		if err := esRequest(esConfig, "PUT", "_ilm/policy/"+b.ILMPolicy, ilmPolicy(b)); err != nil {
+			return err
+		}
+		settings["index.lifecycle.name"] = b.ILMPolicy
+		fmt.Printf("Installed ILM policy %s\n", b.ILMPolicy)
+	}
+
+	componentName := b.TemplateName + "-mappings"
+	component := map[string]interface{}{
+		"template": map[string]interface{}{"mappings": templateMappings(config)},
+	}
+	if err := esRequest(esConfig, "PUT", "_component_template/"+componentName, component); err != nil {
+		return err
+	}
+
+	priority := b.Priority
+	if priority == 0 {
+		priority = 200
+	}
+	indexTemplate := map[string]interface{}{
+		"index_patterns": patterns,
+		"priority":       priority,
+		"composed_of":    []string{componentName},
+		"template":       map[string]interface{}{"settings": settings},
+	}
+	if config.DataStream {
+		indexTemplate["data_stream"] = map[string]interface{}{}
+	}
+	if err := esRequest(esConfig, "PUT", "_index_template/"+b.TemplateName, indexTemplate); err != nil {
+		return err
+	}
+
+	fmt.Printf("Installed index template %s for %s\n", b.TemplateName, strings.Join(patterns, ","))
+	return nil
+}
+
+func esRequest(esConfig *ESTarget, method string, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	esUrl := fmt.Sprintf("%s://%s:%d/%s", esConfig.Protocol, esConfig.Host, esConfig.Port, path)
+	req, err := http.NewRequest(method, esUrl, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	esConfig.setAuth(req)
+
+	res, err := esConfig.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		response, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("%s %s failed: %s %s", method, path, res.Status, response)
+	}
+	return nil
+}
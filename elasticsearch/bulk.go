@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// bulkBody is a bulk request body and the number of documents in it.
+type bulkBody struct {
+	buf  []byte
+	docs int
+}
+
+func (b *bulkBody) reset() {
+	b.buf = b.buf[:0]
+	b.docs = 0
+}
+
+// bulkResponse is the part of a _bulk response that tells which documents
+// were rejected. A 200 response can still reject some of them.
+type bulkResponse struct {
+	Errors bool                    `json:"errors"`
+	Items  []map[string]bulkResult `json:"items"`
+}
+
+// bulkResult is the result of one document, keyed by its action.
+type bulkResult struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type string `json:"type"`
+	} `json:"error"`
+}
+
+// failures returns the number of rejected documents by error kind, e.g.
+// "doc version_conflict_engine_exception".
+func (r *bulkResponse) failures() map[string]int {
+	if !r.Errors {
+		return nil
+	}
+	failures := make(map[string]int)
+	for _, item := range r.Items {
+		for _, result := range item {
+			switch {
+			case result.Error != nil && result.Error.Type != "":
+				failures["doc "+result.Error.Type]++
+			case result.Error != nil || result.Status >= 300:
+				failures[fmt.Sprintf("doc %d", result.Status)]++
+			}
+		}
+	}
+	return failures
+}
+
+// bulkBodies holds the bodies documents are encoded into, so their buffers
+// are reused across requests and intervals instead of being grown again.
+var bulkBodies = sync.Pool{
+	New: func() interface{} { return new(bulkBody) },
+}
+
+func getBulkBody() *bulkBody {
+	return bulkBodies.Get().(*bulkBody)
+}
+
+func putBulkBody(b *bulkBody) {
+	b.reset()
+	bulkBodies.Put(b)
+}
+
+// encodeTags pre-encodes the tags as `"key":"value",` pairs in key order.
+// Tags are the same for every document, so they are encoded once per run.
+func encodeTags(tags map[string]string) []byte {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var encoded []byte
+	for _, k := range keys {
+		encoded = appendJSONString(encoded, k)
+		encoded = append(encoded, ':')
+		encoded = appendJSONString(encoded, tags[k])
+		encoded = append(encoded, ',')
+	}
+	return encoded
+}
+
+// appendBulkDoc appends the action line and the document to a bulk body.
+func appendBulkDoc(buf []byte, action string, encodedTags []byte, level string, msg string, timestamp int64, dataStream bool) []byte {
+	buf = append(buf, action...)
+	buf = append(buf, '{')
+	buf = append(buf, encodedTags...)
+	buf = append(buf, `"level":`...)
+	buf = appendJSONString(buf, level)
+	buf = append(buf, `,"message":`...)
+	buf = appendJSONString(buf, msg)
+	buf = append(buf, `,"time":`...)
+	buf = strconv.AppendInt(buf, timestamp, 10)
+	if dataStream {
+		// data streams reject documents without @timestamp
+		buf = append(buf, `,"@timestamp":`...)
+		buf = strconv.AppendInt(buf, timestamp, 10)
+	}
+	buf = append(buf, "}\n"...)
+	return buf
+}
+
+const hex = "0123456789abcdef"
+
+// appendJSONString appends s as a quoted JSON string, escaping it the same
+// way encoding/json does apart from the optional HTML escaping.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	buf = append(buf, '"')
+	return buf
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBulkFailures(t *testing.T) {
+	tests := []struct {
+		body string
+		want map[string]int
+	}{
+		{`{"took":3,"errors":false,"items":[{"create":{"status":201}}]}`, nil},
+		{`{"errors":true,"items":[
+			{"create":{"status":201}},
+			{"create":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+			{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}},
+			{"create":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+			{"index":{"status":503}}
+		]}`, map[string]int{"doc es_rejected_execution_exception": 2, "doc mapper_parsing_exception": 1, "doc 503": 1}},
+	}
+	for _, tt := range tests {
+		var r bulkResponse
+		if err := json.Unmarshal([]byte(tt.body), &r); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.failures(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("failures of %s = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
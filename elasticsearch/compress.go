@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Request body bytes before and after compression of the requests a sink
+// answered with 200, for the whole run.
+var uncompressedBytes, sentBytes uint64
+
+// countSent counts the body of a request the sink answered with 200.
+func countSent(uncompressed int, wire int) {
+	atomic.AddUint64(&uncompressedBytes, uint64(uncompressed))
+	atomic.AddUint64(&sentBytes, uint64(wire))
+}
+
+func checkCompression(compression string) error {
+	switch compression {
+	case "", "none", "gzip":
+		return nil
+	case "zstd":
+		return errors.New("zstd compression is not supported by this build, use gzip")
+	}
+	return errors.New("compression has to be either none or gzip")
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// countingWriter counts the bytes written through it into n.
+type countingWriter struct {
+	w io.Writer
+	n *int
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += n
+	return n, err
+}
+
+// compressStream returns a reader over the request body and the
+// Content-Encoding to send, which is empty when the body is sent as is.
+// Compressed bodies are streamed through a pipe, so the compressed copy of
+// a bulk is never held in memory. wait has to be called once the request is
+// done, before data is reused, and returns the size of the body as sent.
+func compressStream(compression string, data []byte) (body io.Reader, contentEncoding string, wait func() int) {
+	if compression != "gzip" {
+		return bytes.NewReader(data), "", func() int { return len(data) }
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	wire := 0
+	go func() {
+		defer close(done)
+		writer := gzipWriters.Get().(*gzip.Writer)
+		writer.Reset(countingWriter{pw, &wire})
+		_, err := writer.Write(data)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+		gzipWriters.Put(writer)
+		pw.CloseWithError(err)
+	}()
+
+	return pr, "gzip", func() int {
+		// unblocks the writer if the body was not read to the end
+		pr.Close()
+		<-done
+		return wire
+	}
+}
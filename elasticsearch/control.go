@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// controlState is what the control API changes on a running generator.
+type controlState struct {
+	paused int32
+
+	ratesMu sync.Mutex
+	// logs_per_min set through the control API by definition, "" for a
+	// single config
+	rates map[string]uint64
+
+	// records are drawn from error lines with probability burstRatio
+	// (float64 bits) until burstUntil (unix nanoseconds)
+	burstUntil int64
+	burstRatio uint64
+}
+
+var control = &controlState{rates: make(map[string]uint64)}
+
+func (c *controlState) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+func (c *controlState) setPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&c.paused, v)
+}
+
+// logsPerMin returns the rate of the definition of config.
+func (c *controlState) logsPerMin(config *Config) uint64 {
+	c.ratesMu.Lock()
+	defer c.ratesMu.Unlock()
+	if rate, ok := c.rates[config.definition]; ok {
+		return rate
+	}
+	return config.LogsPerMin
+}
+
+func (c *controlState) setLogsPerMin(definition string, rate uint64) {
+	c.ratesMu.Lock()
+	c.rates[definition] = rate
+	c.ratesMu.Unlock()
+}
+
+func (c *controlState) startBurst(d time.Duration, ratio float64) {
+	atomic.StoreUint64(&c.burstRatio, math.Float64bits(ratio))
+	atomic.StoreInt64(&c.burstUntil, time.Now().Add(d).UnixNano())
+}
+
+// burstUntilTime returns the end of the error burst, zero if there is none.
+func (c *controlState) burstUntilTime() time.Time {
+	until := atomic.LoadInt64(&c.burstUntil)
+	if until < time.Now().UnixNano() {
+		return time.Time{}
+	}
+	return time.Unix(0, until)
+}
+
+// bursting tells whether the next record is part of an error burst.
+func (c *controlState) bursting(r *rand.Rand) bool {
+	if atomic.LoadInt64(&c.burstUntil) < time.Now().UnixNano() {
+		return false
+	}
+	return r.Float64() < math.Float64frombits(atomic.LoadUint64(&c.burstRatio))
+}
+
+func isErrorLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "error", "critical", "fatal":
+		return true
+	}
+	return false
+}
+
+// errorLine returns a random error line of the template, or line as an
+// error if there are none. A line is its level followed by its message.
+func errorLine(logTemplate [][]string, line []string, r *rand.Rand) []string {
+	n := 0
+	for _, l := range logTemplate {
+		if isErrorLevel(l[0]) {
+			n++
+		}
+	}
+	if n == 0 {
+		return []string{"error", line[1]}
+	}
+	n = r.Intn(n)
+	for _, l := range logTemplate {
+		if isErrorLevel(l[0]) {
+			if n == 0 {
+				return l
+			}
+			n--
+		}
+	}
+	return line
+}
+
+// findSinks returns the sinks named name, or of the kind name, e.g. "file"
+// or "es".
+func findSinks(name string) []*sinkStats {
+	var found []*sinkStats
+	for _, s := range allSinks() {
+		if s.name == name || strings.SplitN(s.name, " ", 2)[0] == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+type controlStatus struct {
+	Paused bool    `json:"paused"`
+	Uptime float64 `json:"uptime_seconds"`
+	// LogsPerMin is the sum over all definitions
+	LogsPerMin  uint64                      `json:"logs_per_min"`
+	Definitions map[string]uint64           `json:"definitions_logs_per_min,omitempty"`
+	BurstUntil  *time.Time                  `json:"error_burst_until,omitempty"`
+	Sinks       map[string]controlSinkState `json:"sinks"`
+}
+
+type controlSinkState struct {
+	Enabled  bool   `json:"enabled"`
+	Sent     uint64 `json:"sent"`
+	Failed   uint64 `json:"failed"`
+	InFlight int64  `json:"in_flight"`
+}
+
+func status(configs []*Config, start time.Time) *controlStatus {
+	st := &controlStatus{
+		Paused: control.isPaused(),
+		Uptime: time.Since(start).Seconds(),
+		Sinks:  make(map[string]controlSinkState),
+	}
+	for _, config := range configs {
+		rate := control.logsPerMin(config)
+		st.LogsPerMin += rate
+		if config.definition != "" {
+			if st.Definitions == nil {
+				st.Definitions = make(map[string]uint64)
+			}
+			st.Definitions[config.definition] = rate
+		}
+	}
+	if until := control.burstUntilTime(); !until.IsZero() {
+		st.BurstUntil = &until
+	}
+	for _, s := range allSinks() {
+		st.Sinks[s.name] = controlSinkState{
+			Enabled:  s.enabled(),
+			Sent:     atomic.LoadUint64(&s.sent),
+			Failed:   atomic.LoadUint64(&s.failed),
+			InFlight: atomic.LoadInt64(&s.inFlight),
+		}
+	}
+	return st
+}
+
+// serveControl serves the control API on addr until the process exits:
+//
+//	GET  /status                                  state, rates and sink totals
+//	POST /pause, /resume                          stop and restart generating
+//	POST /rate?logs_per_min=N[&definition=d]      change the rate of a definition, or of all
+//	POST /sinks?name=s&enabled=false              turn a sink, or all sinks of a kind, off or on
+//	POST /error-burst?duration=30s[&ratio=0.5]    draw records from error lines for a while
+func serveControl(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		writeStatus(w, status(runningConfigs(), start))
+	})
+	mux.HandleFunc("/pause", post(func(w http.ResponseWriter, req *http.Request) {
+		control.setPaused(true)
+		fmt.Println("Control: paused")
+		writeStatus(w, status(runningConfigs(), start))
+	}))
+	mux.HandleFunc("/resume", post(func(w http.ResponseWriter, req *http.Request) {
+		control.setPaused(false)
+		fmt.Println("Control: resumed")
+		writeStatus(w, status(runningConfigs(), start))
+	}))
+	mux.HandleFunc("/rate", post(func(w http.ResponseWriter, req *http.Request) {
+		rate, err := strconv.ParseUint(req.FormValue("logs_per_min"), 10, 64)
+		if err != nil || rate == 0 {
+			http.Error(w, "logs_per_min has to be a positive number", http.StatusBadRequest)
+			return
+		}
+		definition := req.FormValue("definition")
+		for _, config := range runningConfigs() {
+			if definition == "" || config.definition == definition {
+				if err := checkLogsPerInterval(rate, config.LogInterval, len(config.templateNames)); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		changed := 0
+		for _, config := range runningConfigs() {
+			if definition == "" || config.definition == definition {
+				control.setLogsPerMin(config.definition, rate)
+				if config.definition == "" {
+					fmt.Printf("Control: logs_per_min set to %d from the next round\n", rate)
+				} else {
+					fmt.Printf("Control: logs_per_min of definition %s set to %d from the next round\n", config.definition, rate)
+				}
+				changed++
+			}
+		}
+		if changed == 0 {
+			http.Error(w, fmt.Sprintf("unknown definition %q", definition), http.StatusNotFound)
+			return
+		}
+		writeStatus(w, status(runningConfigs(), start))
+	}))
+	mux.HandleFunc("/sinks", post(func(w http.ResponseWriter, req *http.Request) {
+		enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "enabled has to be true or false", http.StatusBadRequest)
+			return
+		}
+		found := findSinks(req.FormValue("name"))
+		if len(found) == 0 {
+			http.Error(w, fmt.Sprintf("unknown sink %q", req.FormValue("name")), http.StatusNotFound)
+			return
+		}
+		for _, s := range found {
+			s.setEnabled(enabled)
+			fmt.Printf("Control: sink %s enabled=%t\n", s.name, enabled)
+		}
+		writeStatus(w, status(runningConfigs(), start))
+	}))
+	mux.HandleFunc("/error-burst", post(func(w http.ResponseWriter, req *http.Request) {
+		d, err := time.ParseDuration(req.FormValue("duration"))
+		if err != nil || d <= 0 {
+			http.Error(w, "duration has to be a positive duration, e.g. 30s", http.StatusBadRequest)
+			return
+		}
+		ratio := 1.0
+		if v := req.FormValue("ratio"); v != "" {
+			if ratio, err = strconv.ParseFloat(v, 64); err != nil || ratio <= 0 || ratio > 1 {
+				http.Error(w, "ratio has to be between 0 and 1", http.StatusBadRequest)
+				return
+			}
+		}
+		control.startBurst(d, ratio)
+		fmt.Printf("Control: error burst of %s, ratio %g\n", d, ratio)
+		writeStatus(w, status(runningConfigs(), start))
+	}))
+	fmt.Printf("Serving the control API on http://%s\n", listener.Addr())
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	return nil
+}
+
+// post only lets POST requests through to handler.
+func post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, st *controlStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := json.MarshalIndent(st, "", "  ")
+	w.Write(append(data, '\n'))
+}
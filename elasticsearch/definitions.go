@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// generator is a config being run with its log templates. A run of a
+// definitions directory has one generator per definition.
+type generator struct {
+	// name of the definition, empty for a single config
+	name string
+	// args are the config file followed by the template files
+	args         []string
+	config       *Config
+	logTemplates [][][]string
+}
+
+// sinkName returns the name of a sink of the config in stats, metrics and
+// reports, the target prefixed by the definition in a definitions directory
+// run.
+func (config *Config) sinkName(kind, target string) string {
+	if config.definition == "" {
+		return kind + " " + target
+	}
+	return kind + " " + config.definition + "/" + target
+}
+
+// clients are shared by every target with the same tls and http_client
+// settings, so definitions sending to the same cluster share its connection
+// pool.
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[string]*http.Client)
+)
+
+func clientFor(target *ESTarget, settings HTTPClientConfig) (*http.Client, error) {
+	key, err := json.Marshal([]interface{}{target.TLS, settings})
+	if err != nil {
+		return nil, err
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c := clients[string(key)]; c != nil {
+		return c, nil
+	}
+
+	tlsConfig, err := target.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+	c := settings.newClient(tlsConfig)
+	clients[string(key)] = c
+	return c, nil
+}
+
+// isDefinitionsDir tells whether path is a directory of definitions rather
+// than a config file.
+func isDefinitionsDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// definitionFiles returns the *.json files of dir in order.
+func definitionFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no *.json generator definitions in %s", dir)
+	}
+	return paths, nil
+}
+
+// definitionName returns the name of the definition in path, the file name
+// without .json.
+func definitionName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".json")
+}
+
+// resolveTemplateFiles makes the relative template_files of config relative
+// to dir, the directory of its definition.
+func resolveTemplateFiles(config *Config, dir string) {
+	for i, path := range config.TemplateFiles {
+		if !filepath.IsAbs(path) {
+			config.TemplateFiles[i] = filepath.Join(dir, path)
+		}
+	}
+}
+
+// loadGenerator loads the config and template files in args and checks
+// them. name is the definition name, empty for a single config.
+func loadGenerator(name string, args []string, o overrides) (*generator, error) {
+	config, logTemplates, err := setupGenerator(name, args, o)
+	if err != nil {
+		return nil, err
+	}
+	return &generator{name: name, args: args, config: config, logTemplates: logTemplates}, nil
+}
+
+// loadGenerators loads the config in args, or every definition if args[0]
+// is a definitions directory. The template files in args are used by every
+// definition.
+func loadGenerators(args []string, o overrides) ([]*generator, error) {
+	if !isDefinitionsDir(args[0]) {
+		g, err := loadGenerator("", args, o)
+		if err != nil {
+			return nil, err
+		}
+		return []*generator{g}, nil
+	}
+
+	paths, err := definitionFiles(args[0])
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]*generator, 0, len(paths))
+	for _, path := range paths {
+		g, err := loadGenerator(definitionName(path), append([]string{path}, args[1:]...), o)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		gens = append(gens, g)
+	}
+	return gens, nil
+}
+
+// watchedFiles returns the config file and every template file of the
+// generator.
+func (g *generator) watchedFiles() []string {
+	return append(append([]string{}, g.args...), g.config.TemplateFiles...)
+}
+
+// digest returns the config digest of the run: the digest of the config
+// for a single config, of every definition by name for a directory.
+func digest(gens []*generator) string {
+	if len(gens) == 1 && gens[0].name == "" {
+		return configDigest(gens[0].config)
+	}
+	h := sha256.New()
+	for _, g := range gens {
+		data, err := json.Marshal(g.config)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(h, "%s\n%s\n", g.name, data)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
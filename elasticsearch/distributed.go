@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A distributed run splits the logs_per_min of every config across worker
+// processes. The coordinator hands every worker a job when all of them have
+// joined, workers post their statistics every updateInterval and the
+// coordinator adds them up into one status, summary and report.
+const (
+	updateInterval = 2 * time.Second
+	// workerTimeout is how long the coordinator waits for a worker that
+	// stopped posting updates before it reports it lost
+	workerTimeout = 15 * time.Second
+)
+
+// job is what a worker runs: the configs of the run with the share of their
+// rates of the worker, and the template files they use.
+type job struct {
+	Worker  int `json:"worker"`
+	Workers int `json:"workers"`
+	// Seed of the worker, the run seed plus the worker index
+	Seed        int64           `json:"seed"`
+	Duration    time.Duration   `json:"duration"`
+	Definitions []jobDefinition `json:"definitions"`
+	// Templates are the template files passed to the coordinator as
+	// arguments
+	Templates []jobFile `json:"templates"`
+}
+
+type jobDefinition struct {
+	// Name is empty for a single config
+	Name string `json:"name"`
+	// Config is the config after overrides, its template_files are the
+	// paths of Templates
+	Config    json.RawMessage `json:"config"`
+	Templates []jobFile       `json:"templates"`
+}
+
+// jobFile is a template file, Path is relative to the job directory of the
+// worker and keeps the file name, which names the template in reports.
+type jobFile struct {
+	Path string `json:"path"`
+	Data []byte `json:"data"`
+}
+
+// histData is a histogram snapshot with its non-empty buckets only.
+type histData struct {
+	Counts map[int]uint64 `json:"counts"`
+	Sum    uint64         `json:"sum"`
+	Max    uint64         `json:"max"`
+}
+
+func newHistData(s *histSnapshot) *histData {
+	d := &histData{Counts: make(map[int]uint64), Sum: s.sum, Max: s.max}
+	for i, c := range s.counts {
+		if c > 0 {
+			d.Counts[i] = c
+		}
+	}
+	return d
+}
+
+func (d *histData) snapshot() *histSnapshot {
+	s := &histSnapshot{sum: d.Sum, max: d.Max}
+	for i, c := range d.Counts {
+		if i >= 0 && i < histBuckets {
+			s.counts[i] = c
+			s.total += c
+		}
+	}
+	return s
+}
+
+// sinkData is the state of a sink of a worker.
+type sinkData struct {
+	Name         string                   `json:"name"`
+	Sent         uint64                   `json:"sent"`
+	Failed       uint64                   `json:"failed"`
+	Dropped      uint64                   `json:"dropped"`
+	Bytes        uint64                   `json:"bytes"`
+	DroppedBytes uint64                   `json:"dropped_bytes"`
+	InFlight     int64                    `json:"in_flight"`
+	Errors       map[string]uint64        `json:"errors"`
+	Templates    map[string]templateCount `json:"templates"`
+	Latency      [outcomes]*histData      `json:"latency"`
+	BatchRecords *histData                `json:"batch_records"`
+	BatchBytes   *histData                `json:"batch_bytes"`
+}
+
+type genData struct {
+	Definition string `json:"definition"`
+	Template   string `json:"template"`
+	Level      string `json:"level"`
+	Records    uint64 `json:"records"`
+	Bytes      uint64 `json:"bytes"`
+}
+
+// workerUpdate is what a worker posts to the coordinator, the totals of its
+// run so far. The last update of a run carries the report of the worker.
+type workerUpdate struct {
+	Worker    int         `json:"worker"`
+	Sinks     []*sinkData `json:"sinks"`
+	Generated []*genData  `json:"generated"`
+	Report    *runReport  `json:"report,omitempty"`
+}
+
+type updateResponse struct {
+	// Stop asks the worker to stop its run
+	Stop bool `json:"stop"`
+}
+
+// workerReport describes a worker in the report of a distributed run.
+type workerReport struct {
+	Worker int    `json:"worker"`
+	Host   string `json:"host"`
+	Seed   int64  `json:"seed"`
+	// Complete is false if the worker stopped posting updates before the
+	// end of its run
+	Complete bool `json:"complete"`
+}
+
+// share returns the part of total worker i of n gets.
+func share(total uint64, i, n int) uint64 {
+	s := total / uint64(n)
+	if uint64(i) < total%uint64(n) {
+		s++
+	}
+	return s
+}
+
+// workerConfig returns the config of worker i of n, with its share of
+// logs_per_min and no thresholds, the coordinator checks them on the whole
+// run. templates is the number of log templates of the config.
+func workerConfig(config *Config, templates int, i, n int) (*Config, error) {
+	if config.LogsPerMin < uint64(n) {
+		return nil, fmt.Errorf("logs_per_min %d is less than the %d workers", config.LogsPerMin, n)
+	}
+	c := *config
+	c.Thresholds = nil
+	c.LogsPerMin = share(config.LogsPerMin, i, n)
+	// every template file generates a share of the logs of an interval, see
+	// validate
+	if logsPerInterval := uint64(math.Ceil(float64(c.LogsPerMin) / 60.0 * c.LogInterval)); logsPerInterval < uint64(templates) {
+		return nil, fmt.Errorf("logs_per_min %d across %d workers gives %d logs per log_interval %gs, fewer than the %d template files",
+			config.LogsPerMin, n, logsPerInterval, c.LogInterval, templates)
+	} else if lost := logsPerInterval % uint64(templates); lost > 0 {
+		prefix := ""
+		if config.definition != "" {
+			prefix = "definition " + config.definition + ": "
+		}
+		fmt.Printf("%sWorker %d generates %d of the %d logs per log_interval of its share, they are split evenly across the %d template files\n",
+			prefix, i, logsPerInterval-lost, logsPerInterval, templates)
+	}
+	return &c, nil
+}
+
+// splitJobs returns the jobs of n workers running gens.
+func splitJobs(gens []*generator, templatePaths []string, n int, seed int64, duration time.Duration) ([]*job, error) {
+	// files are read once and named by their position so equal file names
+	// of different directories do not clash
+	files := make(map[string]jobFile)
+	fileFor := func(dir, p string) (jobFile, error) {
+		if f, ok := files[p]; ok {
+			return f, nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return jobFile{}, err
+		}
+		f := jobFile{Path: path.Join(dir, fmt.Sprint(len(files)), filepath.Base(p)), Data: data}
+		files[p] = f
+		return f, nil
+	}
+
+	var argTemplates []jobFile
+	for _, p := range templatePaths {
+		f, err := fileFor("args", p)
+		if err != nil {
+			return nil, err
+		}
+		argTemplates = append(argTemplates, f)
+	}
+
+	jobs := make([]*job, n)
+	for i := range jobs {
+		jobs[i] = &job{Worker: i, Workers: n, Seed: seed + int64(i), Duration: duration, Templates: argTemplates}
+		for _, g := range gens {
+			config, err := workerConfig(g.config, len(g.logTemplates), i, n)
+			if err != nil {
+				return nil, err
+			}
+			def := jobDefinition{Name: g.name}
+			rewrite := func(paths []string) ([]string, error) {
+				var rewritten []string
+				for _, p := range paths {
+					f, err := fileFor("templates", p)
+					if err != nil {
+						return nil, err
+					}
+					def.Templates = append(def.Templates, f)
+					rewritten = append(rewritten, f.Path)
+				}
+				return rewritten, nil
+			}
+			if config.TemplateFiles, err = rewrite(config.TemplateFiles); err != nil {
+				return nil, err
+			}
+			if def.Config, err = json.Marshal(config); err != nil {
+				return nil, err
+			}
+			jobs[i].Definitions = append(jobs[i].Definitions, def)
+		}
+	}
+	return jobs, nil
+}
+
+// coordinator hands out the jobs of a distributed run and keeps the latest
+// update of every worker.
+type coordinator struct {
+	mu   sync.Mutex
+	jobs []*job
+	// hosts of the workers by index, empty for slots not taken yet
+	hosts    []string
+	joined   int
+	ready    chan struct{}
+	updates  []*workerUpdate
+	lastSeen []time.Time
+	finished []bool
+	lost     []bool
+	stopping bool
+	// sinks hold the sums of the worker sinks for the status and summary
+	sinks map[string]*sinkStats
+}
+
+func newCoordinator(jobs []*job) *coordinator {
+	n := len(jobs)
+	return &coordinator{
+		jobs:     jobs,
+		hosts:    make([]string, n),
+		ready:    make(chan struct{}),
+		updates:  make([]*workerUpdate, n),
+		lastSeen: make([]time.Time, n),
+		finished: make([]bool, n),
+		lost:     make([]bool, n),
+		sinks:    make(map[string]*sinkStats),
+	}
+}
+
+func (c *coordinator) started() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// join takes the first free worker slot and answers with its job once all
+// workers have joined.
+func (c *coordinator) join(w http.ResponseWriter, req *http.Request) {
+	var hello struct {
+		Host string `json:"host"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&hello); err != nil || hello.Host == "" {
+		hello.Host = req.RemoteAddr
+	}
+
+	c.mu.Lock()
+	worker := -1
+	for i, host := range c.hosts {
+		if host == "" {
+			worker = i
+			break
+		}
+	}
+	if worker < 0 {
+		c.mu.Unlock()
+		http.Error(w, fmt.Sprintf("all %d workers have joined", len(c.hosts)), http.StatusConflict)
+		return
+	}
+	c.hosts[worker] = hello.Host
+	c.joined++
+	fmt.Printf("Worker %d joined from %s, %d of %d\n", worker, hello.Host, c.joined, len(c.hosts))
+	if c.joined == len(c.hosts) {
+		close(c.ready)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-c.ready:
+		writeJSON(w, c.jobs[worker])
+	case <-req.Context().Done():
+		c.mu.Lock()
+		if !c.started() {
+			c.hosts[worker] = ""
+			c.joined--
+			fmt.Printf("Worker %d left before the run started\n", worker)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// update keeps the update a worker posted and tells it whether to stop.
+func (c *coordinator) update(w http.ResponseWriter, req *http.Request) {
+	var u workerUpdate
+	if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started() || u.Worker < 0 || u.Worker >= len(c.jobs) {
+		http.Error(w, fmt.Sprintf("unknown worker %d", u.Worker), http.StatusBadRequest)
+		return
+	}
+	if c.finished[u.Worker] && !c.lost[u.Worker] {
+		writeJSON(w, updateResponse{Stop: true})
+		return
+	}
+	c.updates[u.Worker] = &u
+	c.lastSeen[u.Worker] = time.Now()
+	if c.lost[u.Worker] {
+		c.lost[u.Worker] = false
+		c.finished[u.Worker] = false
+		fmt.Printf("Worker %d is reporting again\n", u.Worker)
+	}
+	if u.Report != nil {
+		c.finished[u.Worker] = true
+		fmt.Printf("Worker %d finished\n", u.Worker)
+	}
+	c.aggregate()
+	writeJSON(w, updateResponse{Stop: c.stopping})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := json.Marshal(v)
+	w.Write(append(data, '\n'))
+}
+
+// aggregate sets the coordinator sinks and generated counts to the sums of
+// the latest worker updates. It is called with mu held.
+func (c *coordinator) aggregate() {
+	type sinkParts struct {
+		data     sinkData
+		latency  [outcomes]*histSnapshot
+		batchRec *histSnapshot
+		batchLen *histSnapshot
+	}
+	sums := make(map[string]*sinkParts)
+	var names []string
+	counts := make(map[genKey]*genCount)
+	for _, u := range c.updates {
+		if u == nil {
+			continue
+		}
+		for _, d := range u.Sinks {
+			p := sums[d.Name]
+			if p == nil {
+				p = &sinkParts{data: sinkData{Errors: make(map[string]uint64), Templates: make(map[string]templateCount)}, batchRec: &histSnapshot{}, batchLen: &histSnapshot{}}
+				for outcome := range p.latency {
+					p.latency[outcome] = &histSnapshot{}
+				}
+				sums[d.Name] = p
+				names = append(names, d.Name)
+			}
+			p.data.Sent += d.Sent
+			p.data.Failed += d.Failed
+			p.data.Dropped += d.Dropped
+			p.data.Bytes += d.Bytes
+			p.data.DroppedBytes += d.DroppedBytes
+			p.data.InFlight += d.InFlight
+			for kind, n := range d.Errors {
+				p.data.Errors[kind] += n
+			}
+			for template, n := range d.Templates {
+				sum := p.data.Templates[template]
+				sum.Sent += n.Sent
+				sum.Failed += n.Failed
+				p.data.Templates[template] = sum
+			}
+			for outcome, h := range d.Latency {
+				if h != nil {
+					p.latency[outcome] = p.latency[outcome].merge(h.snapshot())
+				}
+			}
+			if d.BatchRecords != nil {
+				p.batchRec = p.batchRec.merge(d.BatchRecords.snapshot())
+			}
+			if d.BatchBytes != nil {
+				p.batchLen = p.batchLen.merge(d.BatchBytes.snapshot())
+			}
+		}
+		for _, g := range u.Generated {
+			key := genKey{definition: g.Definition, template: g.Template, level: g.Level}
+			if counts[key] == nil {
+				counts[key] = &genCount{}
+			}
+			counts[key].records += g.Records
+			counts[key].bytes += g.Bytes
+		}
+	}
+
+	for _, name := range names {
+		p := sums[name]
+		s := c.sinks[name]
+		if s == nil {
+			s = newSinkStats(name)
+			c.sinks[name] = s
+		}
+		atomic.StoreUint64(&s.sent, p.data.Sent)
+		atomic.StoreUint64(&s.failed, p.data.Failed)
+		atomic.StoreUint64(&s.dropped, p.data.Dropped)
+		atomic.StoreUint64(&s.bytes, p.data.Bytes)
+		atomic.StoreUint64(&s.droppedBytes, p.data.DroppedBytes)
+		atomic.StoreInt64(&s.inFlight, p.data.InFlight)
+		s.errorsMu.Lock()
+		s.errors = p.data.Errors
+		s.errorsMu.Unlock()
+		templates := make(map[string]*templateCount, len(p.data.Templates))
+		for template, n := range p.data.Templates {
+			n := n
+			templates[template] = &n
+		}
+		s.templatesMu.Lock()
+		s.templates = templates
+		s.templatesMu.Unlock()
+		for outcome := range p.latency {
+			s.latency[outcome].load(p.latency[outcome])
+		}
+		s.batchRecords.load(p.batchRec)
+		s.batchBytes.load(p.batchLen)
+	}
+
+	generatedMu.Lock()
+	generated = counts
+	generatedMu.Unlock()
+}
+
+// report returns the report of the run from the latest worker updates. Rates
+// are the sums of the rates the workers reported over their own runs.
+func (c *coordinator) report(gens []*generator, seed int64, start, end time.Time) *runReport {
+	report := buildReport(gens, seed, start, end, make([]int, len(gens)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total float64
+	for _, g := range gens {
+		var actual float64
+		for _, u := range c.updates {
+			if u == nil || u.Report == nil {
+				continue
+			}
+			if g.name == "" && u.Report.Rate != nil {
+				actual += u.Report.Rate.Actual
+			} else if def := u.Report.Definitions[g.name]; def != nil {
+				actual += def.Rate.Actual
+			}
+		}
+		rate := report.Rate
+		if g.name != "" {
+			rate = report.Definitions[g.name].Rate
+		}
+		rate.Actual = actual
+		if rate.Target > 0 {
+			rate.Adherence = rate.Actual / rate.Target
+		}
+		total += actual
+	}
+	report.Rate.Actual = total
+	if report.Rate.Target > 0 {
+		report.Rate.Adherence = report.Rate.Actual / report.Rate.Target
+	}
+	for i, job := range c.jobs {
+		report.Workers = append(report.Workers, &workerReport{Worker: i, Host: c.hosts[i], Seed: job.Seed, Complete: c.finished[i] && !c.lost[i]})
+	}
+	return report
+}
+
+// coordinatorOptions are the coordinate command flags.
+type coordinatorOptions struct {
+	runOptions
+	listen  string
+	workers int
+}
+
+// runCoordinator splits gens across opts.workers workers, waits for them to
+// join and for their runs to end, printing the status of the whole run each
+// statsInterval. It then prints the summary, checks the thresholds and writes
+// the run report if asked, like runGenerator.
+func runCoordinator(gens []*generator, templatePaths []string, opts coordinatorOptions) error {
+	jobs, err := splitJobs(gens, templatePaths, opts.workers, opts.seed, opts.duration)
+	if err != nil {
+		return err
+	}
+	c := newCoordinator(jobs)
+
+	listener, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/join", post(c.join))
+	mux.HandleFunc("/update", post(c.update))
+	go http.Serve(listener, mux)
+
+	// sinks are created as workers report them, Elasticsearch targets of
+	// es_key configs are only known to the workers
+	for _, g := range gens {
+		setRunning(g.config)
+	}
+	if opts.metricsAddr != "" {
+		if err := serveMetrics(opts.metricsAddr); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Using seed %d\n", opts.seed)
+	fmt.Printf("Waiting for %d workers on %s, start them with: loggen-es worker -coordinator %s\n", opts.workers, listener.Addr(), listener.Addr())
+	interrupt := stopSignal(0, nil)
+	select {
+	case <-c.ready:
+	case <-interrupt:
+		return errors.New("Stopped before all workers joined")
+	}
+
+	start := time.Now()
+	c.mu.Lock()
+	for i := range c.lastSeen {
+		c.lastSeen[i] = start
+	}
+	c.mu.Unlock()
+	fmt.Printf("All %d workers joined, each runs its share of logs_per_min\n", opts.workers)
+
+	done := make(chan struct{})
+	if !quiet && opts.statsInterval > 0 {
+		go reportStatus(opts.statsInterval, done)
+	}
+	ticker := time.NewTicker(time.Second)
+	for running := true; running; {
+		select {
+		case <-interrupt:
+			interrupt = nil
+			c.mu.Lock()
+			c.stopping = true
+			c.mu.Unlock()
+			fmt.Println("Stopping the workers")
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		running = false
+		for i := range c.jobs {
+			if c.finished[i] {
+				continue
+			}
+			if time.Since(c.lastSeen[i]) > workerTimeout {
+				c.finished[i] = true
+				c.lost[i] = true
+				fmt.Printf("Worker %d (%s) stopped posting updates, its last update is used\n", i, c.hosts[i])
+				continue
+			}
+			running = true
+		}
+		c.mu.Unlock()
+	}
+	ticker.Stop()
+	close(done)
+	end := time.Now()
+	printSummary(end.Sub(start))
+
+	report := c.report(gens, opts.seed, start, end)
+	report.Thresholds = checkThresholds(gens, report)
+	for _, g := range gens {
+		if g.config.Thresholds != nil {
+			printThresholds(report.Thresholds)
+			break
+		}
+	}
+	if opts.report != "" {
+		if err := writeReport(opts.report, report); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote run report to %s\n", opts.report)
+	}
+	if !report.Thresholds.Passed {
+		return errThresholdsViolated
+	}
+	return nil
+}
+
+// collectUpdate returns the totals of the run of worker so far.
+func collectUpdate(worker int) *workerUpdate {
+	u := &workerUpdate{Worker: worker, Sinks: []*sinkData{}, Generated: []*genData{}}
+	for _, s := range allSinks() {
+		d := &sinkData{
+			Name:         s.name,
+			Sent:         atomic.LoadUint64(&s.sent),
+			Failed:       atomic.LoadUint64(&s.failed),
+			Dropped:      atomic.LoadUint64(&s.dropped),
+			Bytes:        atomic.LoadUint64(&s.bytes),
+			DroppedBytes: atomic.LoadUint64(&s.droppedBytes),
+			InFlight:     atomic.LoadInt64(&s.inFlight),
+			Errors:       s.errorCounts(),
+			Templates:    s.templateCounts(),
+			BatchRecords: newHistData(s.batchRecords.whole()),
+			BatchBytes:   newHistData(s.batchBytes.whole()),
+		}
+		for outcome := range d.Latency {
+			d.Latency[outcome] = newHistData(s.latency[outcome].whole())
+		}
+		u.Sinks = append(u.Sinks, d)
+	}
+	for key, n := range generatedCounts() {
+		u.Generated = append(u.Generated, &genData{Definition: key.definition, Template: key.template, Level: key.level, Records: n.records, Bytes: n.bytes})
+	}
+	return u
+}
+
+// coordinatorURL returns the URL of path on the coordinator at addr, which
+// may be given with or without http://.
+func coordinatorURL(addr, path string) string {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+// joinCoordinator joins the run of the coordinator at addr and returns the
+// job of the worker, waiting for the coordinator to come up.
+func joinCoordinator(addr string) (*job, error) {
+	host, _ := os.Hostname()
+	hello, _ := json.Marshal(map[string]string{"host": fmt.Sprintf("%s/%d", host, os.Getpid())})
+	waiting := false
+	for {
+		resp, err := http.Post(coordinatorURL(addr, "/join"), "application/json", bytes.NewReader(hello))
+		if err != nil {
+			if !waiting {
+				fmt.Printf("Waiting for the coordinator at %s: %v\n", addr, err)
+				waiting = true
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Coordinator at %s refused to join: %s", addr, strings.TrimSpace(string(body)))
+		}
+		var j job
+		if err := json.Unmarshal(body, &j); err != nil {
+			return nil, err
+		}
+		return &j, nil
+	}
+}
+
+// postUpdate posts u to the coordinator at addr and tells whether the
+// coordinator asked to stop.
+func postUpdate(client *http.Client, addr string, u *workerUpdate) (bool, error) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Post(coordinatorURL(addr, "/update"), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("http %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var r updateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return false, err
+	}
+	return r.Stop, nil
+}
+
+// writeJob writes the configs and template files of j into dir and returns
+// the arguments to load them with: the config file or definitions directory
+// followed by the template files.
+func writeJob(j *job, dir string) ([]string, error) {
+	write := func(f jobFile) (string, error) {
+		p := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+f.Path)))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return "", err
+		}
+		return p, ioutil.WriteFile(p, f.Data, 0644)
+	}
+
+	var templatePaths []string
+	for _, f := range j.Templates {
+		p, err := write(f)
+		if err != nil {
+			return nil, err
+		}
+		templatePaths = append(templatePaths, p)
+	}
+
+	configPath := filepath.Join(dir, "definitions")
+	for _, def := range j.Definitions {
+		for _, f := range def.Templates {
+			if _, err := write(f); err != nil {
+				return nil, err
+			}
+		}
+		var config Config
+		if err := json.Unmarshal(def.Config, &config); err != nil {
+			return nil, err
+		}
+		resolveTemplateFiles(&config, dir)
+		data, err := json.Marshal(&config)
+		if err != nil {
+			return nil, err
+		}
+		name := "definitions/" + def.Name + ".json"
+		if def.Name == "" {
+			name = "config.json"
+			configPath = filepath.Join(dir, name)
+		}
+		if _, err := write(jobFile{Path: name, Data: data}); err != nil {
+			return nil, err
+		}
+	}
+	return append([]string{configPath}, templatePaths...), nil
+}
+
+// runWorker joins the coordinator at addr and runs the job it hands out,
+// posting the statistics of the run every updateInterval and once more with
+// the report of the run when it ends.
+func runWorker(addr string, opts runOptions) error {
+	j, err := joinCoordinator(addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Joined the coordinator at %s as worker %d of %d\n", addr, j.Worker, j.Workers)
+
+	dir, err := ioutil.TempDir("", "loggen-worker")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	args, err := writeJob(j, dir)
+	if err != nil {
+		return err
+	}
+	gens, err := loadGenerators(args, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	posted := func(asked bool, err error) {
+		if err != nil {
+			fmt.Printf("Could not post an update to the coordinator: %v\n", err)
+		} else if asked {
+			stopOnce.Do(func() { close(stop) })
+		}
+	}
+	finished := make(chan struct{})
+	updating := make(chan struct{})
+	go func() {
+		defer close(updating)
+		ticker := time.NewTicker(updateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+			}
+			posted(postUpdate(client, addr, collectUpdate(j.Worker)))
+		}
+	}()
+
+	var report *runReport
+	opts.seed = j.Seed
+	opts.duration = j.Duration
+	opts.stop = stop
+	opts.done = func(r *runReport) { report = r }
+	runErr := runGenerator(gens, opts)
+	close(finished)
+	<-updating
+
+	// the coordinator takes a worker whose run failed as finished too
+	if report == nil {
+		report = &runReport{}
+	}
+	u := collectUpdate(j.Worker)
+	u.Report = report
+	for attempt := 0; ; attempt++ {
+		_, err := postUpdate(client, addr, u)
+		if err == nil || attempt == 2 {
+			if err != nil {
+				fmt.Printf("Could not post the report to the coordinator: %v\n", err)
+			}
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	return runErr
+}
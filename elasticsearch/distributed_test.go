@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestShare(t *testing.T) {
+	tests := []struct {
+		total uint64
+		n     int
+		want  []uint64
+	}{
+		{0, 3, []uint64{0, 0, 0}},
+		{1, 3, []uint64{1, 0, 0}},
+		{9, 3, []uint64{3, 3, 3}},
+		{10, 3, []uint64{4, 3, 3}},
+		{11, 3, []uint64{4, 4, 3}},
+		{600, 1, []uint64{600}},
+		{150000, 7, []uint64{21429, 21429, 21429, 21429, 21428, 21428, 21428}},
+	}
+	for _, tt := range tests {
+		var sum uint64
+		for i, want := range tt.want {
+			got := share(tt.total, i, tt.n)
+			if got != want {
+				t.Errorf("share(%d, %d, %d) = %d, want %d", tt.total, i, tt.n, got, want)
+			}
+			sum += got
+		}
+		if sum != tt.total {
+			t.Errorf("shares of %d across %d workers sum to %d", tt.total, tt.n, sum)
+		}
+	}
+}
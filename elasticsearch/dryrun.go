@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// dryRun prints the first records of every template file to stdout in the
+// wire format of each enabled target instead of writing or sending them:
+// log file lines and the ES bulk body. Section headers go to stderr, so
+// stdout only holds the records.
+func dryRun(config *Config, logTemplates [][][]string, seed int64, records int) {
+	index := "the SnappyFlow index of the project"
+	if config.IndexName != "" {
+		index = strings.ToLower(formatIndexName(config.IndexName, time.Now().UTC()))
+	}
+
+	for i, logTemplate := range logTemplates {
+		n := records / len(logTemplates)
+		if i < records%len(logTemplates) {
+			n++
+		}
+
+		r := rand.New(rand.NewSource(workerSeed(definitionSeed(seed, config.definition), i, 0)))
+		esLogs := getBulkBody()
+		var logLines []byte
+		for j := 0; j < n; j++ {
+			time, level, msg := generateLogLevelMsg(config.Tags, config.TimeFormat, r, logTemplate[r.Intn(len(logTemplate))])
+			if config.FileWrite || !config.ESSend {
+				logLines = append(logLines, time+" "+level+" "+msg+"\n"...)
+			}
+			if config.ESSend {
+				generateESLog(config, level, msg, esLogs)
+			}
+		}
+
+		if len(logLines) > 0 {
+			fmt.Fprintf(os.Stderr, "# template file %d: %d logs to %s/%s (seed %d)\n", i+1, n, config.FilePath, config.FileName, seed)
+			os.Stdout.Write(logLines)
+		}
+		if config.ESSend {
+			fmt.Fprintf(os.Stderr, "# template file %d: bulk of %d documents to %s (seed %d)\n", i+1, n, index, seed)
+			os.Stdout.Write(esLogs.buf)
+		}
+		putBulkBody(esLogs)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -21,6 +23,32 @@ func unpad(origData []byte) []byte {
 	return origData[:(length - unpadding)]
 }
 
+func pad(origData []byte, blockSize int) []byte {
+	padding := blockSize - len(origData)%blockSize
+	return append(origData, bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
+
+func aesCBCEncrypt(origData, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := block.BlockSize()
+	origData = pad(origData, blockSize)
+
+	encryptData := make([]byte, blockSize+len(origData))
+	iv := encryptData[:blockSize]
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	mode := cipher.NewCBCEncrypter(block, iv)
+
+	mode.CryptBlocks(encryptData[blockSize:], origData)
+	return encryptData, nil
+}
+
 func aesCBCDecrypt(encryptData, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -58,6 +86,15 @@ func Decrypt(rawData string, key []byte) (string, error) {
 	return string(dnData), nil
 }
 
+// Encrypt is the inverse of Decrypt, the IV is random.
+func Encrypt(rawData string, key []byte) (string, error) {
+	enData, err := aesCBCEncrypt([]byte(rawData), key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(enData), nil
+}
+
 func createTargetsFromKey(c *Config) (SnappyFlowKeyData, error) {
 	data, err := Decrypt(c.ESKey, []byte(DecryptionKey))
 	if err != nil {
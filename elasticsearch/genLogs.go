@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,10 +12,14 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -32,27 +35,65 @@ type SnappyFlowKeyData struct {
 	Protocol  string `json:"protocol"`
 }
 
+// ESTarget is the Elasticsearch cluster logs are sent to. It is either set
+// directly in the config or decoded from the SnappyFlow es_key.
+type ESTarget struct {
+	Host        string    `json:"host"`
+	Port        int       `json:"port"`
+	Protocol    string    `json:"protocol"`
+	ProfileID   string    `json:"profile_id"`
+	Username    string    `json:"username"`
+	Password    string    `json:"password"`
+	APIKey      string    `json:"api_key"`
+	BearerToken string    `json:"bearer_token"`
+	TLS         TLSConfig `json:"tls"`
+
+	client *http.Client
+	stats  *sinkStats
+}
+
 type Config struct {
-	FilePath       string  `json:"file_path"`
-	FileName       string  `json:"file_name"`
-	FileSizeRotate uint64  `json:"file_size_rotate"`
-	Compress       bool    `json:"compress_old_logs"`
-	BulkSize       float64 `json:"bulk_size"`
-	ESKey          string  `json:"es_key"`
-	ProjectName    string  `json:"project_name"`
-	Tags           Tags    `json:"tags"`
-	LogsPerMin     uint64  `json:"logs_per_min"`
-	LogInterval    float64 `json:"log_interval"`
-	TimeFormat     string  `json:"time_format"`
-	FileWrite      bool    `json:"file_write"`
-	ESSend         bool    `json:"es_send"`
+	FilePath       string           `json:"file_path"`
+	FileName       string           `json:"file_name"`
+	FileSizeRotate uint64           `json:"file_size_rotate"`
+	Compress       bool             `json:"compress_old_logs"`
+	BulkSize       float64          `json:"bulk_size"`
+	ESKey          string           `json:"es_key"`
+	ProjectName    string           `json:"project_name"`
+	Tags           Tags             `json:"tags"`
+	LogsPerMin     uint64           `json:"logs_per_min"`
+	LogInterval    float64          `json:"log_interval"`
+	TimeFormat     string           `json:"time_format"`
+	FileWrite      bool             `json:"file_write"`
+	ESSend         bool             `json:"es_send"`
+	IndexName      string           `json:"index_name"`
+	DataStream     bool             `json:"data_stream"`
+	DocType        string           `json:"doc_type"`
+	ESTarget       *ESTarget        `json:"es_target"`
+	Bootstrap      *BootstrapConfig `json:"bootstrap"`
+	Compression    string           `json:"compression"`
+	HTTPClient     HTTPClientConfig `json:"http_client"`
+	Thresholds     *Thresholds      `json:"thresholds"`
+	TemplateFiles  []string         `json:"template_files"`
+
+	// definition is the name of the definition in a definitions directory
+	// run, empty for a single config
+	definition string
+	// fileStats is the sink of file_write, set by runGenerator
+	fileStats   *sinkStats
+	encodedTags []byte
+	// templateNames are the file names of the log templates
+	templateNames []string
 }
 
-func processLogTemlates(args []string) [][][]string {
+// processLogTemlates reads the template files in args[1:] and returns the
+// templates of the files that have any, with the file names.
+func processLogTemlates(args []string) ([][][]string, []string) {
 	var logTemplates [][][]string
-	noOfLogTemplates := len(args) - 2
+	var names []string
+	noOfLogTemplates := len(args) - 1
 	for i := 0; i < noOfLogTemplates; i++ {
-		file, err := os.Open(args[i+2])
+		file, err := os.Open(args[i+1])
 		defer file.Close()
 
 		if err != nil {
@@ -62,6 +103,9 @@ func processLogTemlates(args []string) [][][]string {
 		reader := bufio.NewReader(file)
 
 		var logTemplate [][]string
+		// continuing is set while the lines continue the message of the last
+		// template
+		continuing := false
 		for {
 			line, err := reader.ReadString('\n')
 
@@ -73,6 +117,12 @@ func processLogTemlates(args []string) [][][]string {
 				log.Fatal(err)
 			}
 
+			if text, ok := continuation(line); ok && continuing {
+				logTemplate[len(logTemplate)-1][1] += "\n" + text
+				continue
+			}
+			continuing = false
+
 			var logInfo []string
 			line = strings.TrimSpace(line)
 			index := strings.Index(line, ",")
@@ -96,30 +146,77 @@ func processLogTemlates(args []string) [][][]string {
 
 			logInfo = append(logInfo, strings.TrimSpace(msgInfo[index1+1:]))
 			logTemplate = append(logTemplate, logInfo)
+			continuing = true
 		}
 		if len(logTemplate) > 0 {
 			logTemplates = append(logTemplates, logTemplate)
+			names = append(names, filepath.Base(args[i+1]))
 		}
 	}
-	return logTemplates
+	return logTemplates, names
 }
 
-func startLogGeneration(config *Config, esConfig SnappyFlowKeyData, logTemplates [][][]string) {
-	var logsPerInterval uint64 = uint64(math.Ceil(float64(config.LogsPerMin) / 60.0 * config.LogInterval))
-	//fmt.Println(logsPerInterval)
-	for {
-		fmt.Println("---------------------------------------------------------------------")
+// logsPerInterval returns the number of logs generated every log_interval at
+// logsPerMin.
+func logsPerInterval(logsPerMin uint64, logInterval float64) uint64 {
+	return uint64(math.Ceil(float64(logsPerMin) / 60.0 * logInterval))
+}
+
+// checkLogsPerInterval returns an error when logsPerMin gives fewer logs per
+// log_interval than there are template files: every template file gets an
+// equal share of the logs of an interval and a routine with no logs to
+// generate never finishes.
+func checkLogsPerInterval(logsPerMin uint64, logInterval float64, templates int) error {
+	if n := logsPerInterval(logsPerMin, logInterval); n < uint64(templates) {
+		return fmt.Errorf("logs_per_min %d with log_interval %g gives %d logs per interval, fewer than the %d template files",
+			logsPerMin, logInterval, n, templates)
+	}
+	return nil
+}
+
+// startLogGeneration generates a round of logs of g every log_interval until
+// stop is closed and returns the number of rounds. Generators received on
+// reloads are used from the next round.
+func startLogGeneration(g *generator, esConfig *ESTarget, seed int64, reloads <-chan *generator, stop <-chan struct{}) int {
+	config, logTemplates := g.config, g.logTemplates
+	for round := 0; ; round++ {
 		start := time.Now()
-		fmt.Println(start)
-		fmt.Println()
 
+		select {
+		case loaded := <-reloads:
+			swapConfig(config, loaded)
+			config, logTemplates = loaded.config, loaded.logTemplates
+			fmt.Printf("Reloaded %s and %d template files\n", loaded.args[0], len(logTemplates))
+		default:
+		}
+
+		if control.isPaused() {
+			select {
+			case <-stop:
+				return round
+			case <-time.After(time.Duration(config.LogInterval * float64(time.Second))):
+			}
+			continue
+		}
+
+		logsPerMin := control.logsPerMin(config)
+		if err := checkLogsPerInterval(logsPerMin, config.LogInterval, len(logTemplates)); err != nil {
+			fmt.Printf("Round %d skipped: %v\n", round, err)
+			select {
+			case <-stop:
+				return round
+			case <-time.After(time.Duration(config.LogInterval * float64(time.Second))):
+			}
+			continue
+		}
 		noOfLogtemplates := len(logTemplates)
 		routineDone := make(chan bool, noOfLogtemplates)
 		mutex := &sync.Mutex{}
 
-		var logsPerRoutine uint64 = logsPerInterval / uint64(len(logTemplates))
+		var logsPerRoutine uint64 = logsPerInterval(logsPerMin, config.LogInterval) / uint64(len(logTemplates))
 		for i := 0; i < len(logTemplates); i++ {
-			go createLog(config, esConfig, logTemplates[i], len(logTemplates[i]), config.TimeFormat, logsPerRoutine, mutex, routineDone)
+			r := rand.New(rand.NewSource(workerSeed(seed, i, round)))
+			go createLog(config, esConfig, config.templateNames[i], logTemplates[i], len(logTemplates[i]), config.TimeFormat, logsPerRoutine, r, mutex, routineDone)
 		}
 
 		for i := 0; i < noOfLogtemplates; i++ {
@@ -127,59 +224,84 @@ func startLogGeneration(config *Config, esConfig SnappyFlowKeyData, logTemplates
 		}
 		close(routineDone)
 
-		fmt.Println()
-		fmt.Println(time.Now())
 		elapsedTime := time.Since(start).Seconds()
-		fmt.Printf("Log Generation took %f\n", elapsedTime)
-
 		sleepTime := config.LogInterval - elapsedTime
-		if sleepTime > 0 {
-			fmt.Printf("Sleep for %f\n", sleepTime)
+		definition := ""
+		if config.definition != "" {
+			definition = config.definition + ": "
 		}
+		progressf("%sRound %d: generated %d logs in %fs, sleep for %fs\n", definition, round, logsPerRoutine*uint64(noOfLogtemplates), elapsedTime, math.Max(sleepTime, 0))
 
-		fmt.Println("======================================================================")
-		time.Sleep(time.Duration(sleepTime) * time.Second)
+		select {
+		case <-stop:
+			return round + 1
+		case <-time.After(time.Duration(sleepTime * float64(time.Second))):
+		}
 	}
 }
 
-func createLog(config *Config, esConfig SnappyFlowKeyData, logTemplate [][]string, size int, timeFormat string, logsPerRoutine uint64, mutex *sync.Mutex, routineDone chan<- bool) {
+func createLog(config *Config, esConfig *ESTarget, templateName string, logTemplate [][]string, size int, timeFormat string, logsPerRoutine uint64, r *rand.Rand, mutex *sync.Mutex, routineDone chan<- bool) {
 
-	var esLogs [][]byte
+	esLogs := getBulkBody()
+	defer putBulkBody(esLogs)
 	//var logLines string = ""
 	var logLine string = ""
 
-	seed := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(seed)
 	var count uint64 = 0
-	var esLogsSize uint64 = 0
+	tally := make(genTally)
 	for {
-		time, level, msg := generateLogLevelMsg(config.Tags, timeFormat, r, logTemplate[r.Intn(size)])
+		logInfo := logTemplate[r.Intn(size)]
+		if control.bursting(r) {
+			logInfo = errorLine(logTemplate, logInfo, r)
+		}
+		time, level, msg := generateLogLevelMsg(config.Tags, timeFormat, r, logInfo)
 		if config.FileWrite {
 			logLine = time + " " + level + " " + msg + "\n"
 			//logLines = logLines + logLine
 		}
 		if config.ESSend {
-			esLogs = generateESLog(config.Tags, level, msg, esLogs, &esLogsSize)
+			n := len(esLogs.buf)
+			generateESLog(config, level, msg, esLogs)
+			tally.add(genKey{config.definition, templateName, level}, len(esLogs.buf)-n)
+		} else {
+			tally.add(genKey{config.definition, templateName, level}, len(logLine))
 		}
 
 		count++
 		//Write 100 logs in buffer to file
 		//if count == logsPerRoutine || count%100 == 0 {
-		//fmt.Printf("es logs size: %d\n",esLogsSize)
-		if config.FileWrite {
+		if config.FileWrite && config.fileStats.enabled() {
 			mutex.Lock()
+			start := config.fileStats.begin()
 			err := writeLogsToFile(config, []byte(logLine))
 			if err != nil {
 				fmt.Println(err)
+				config.fileStats.done(start, 1, 1, len(logLine))
+				config.fileStats.fail("write", 1)
+				config.fileStats.countTemplate(templateName, 1, 1)
+			} else {
+				config.fileStats.done(start, 1, 0, len(logLine))
+				config.fileStats.countTemplate(templateName, 1, 0)
 			}
 			mutex.Unlock()
 			logLine = ""
+		} else if config.FileWrite {
+			config.fileStats.drop(1, len(logLine))
+			config.fileStats.fail("disabled", 1)
+			config.fileStats.countTemplate(templateName, 1, 1)
+			logLine = ""
 		}
-		if count == logsPerRoutine || ((float64)(esLogsSize/1024)/1024) >= config.BulkSize {
+		if count == logsPerRoutine || ((float64)(len(esLogs.buf)/1024)/1024) >= config.BulkSize {
+			tally.flush()
 			if config.ESSend {
-				sendToElasticSearch(config, esConfig, esLogs)
-				esLogs = esLogs[:0]
-				esLogsSize = 0
+				if esConfig.stats.enabled() {
+					sendToElasticSearch(config, esConfig, templateName, esLogs)
+				} else if esLogs.docs > 0 {
+					esConfig.stats.drop(esLogs.docs, len(esLogs.buf))
+					esConfig.stats.fail("disabled", esLogs.docs)
+					esConfig.stats.countTemplate(templateName, esLogs.docs, esLogs.docs)
+				}
+				esLogs.reset()
 			}
 			if count == logsPerRoutine {
 				break
@@ -271,87 +393,149 @@ func generateLogLevelMsg(tagMap map[string]string, timeFormat string, r *rand.Ra
 
 		msg = msg[:index] + port + msg[index+4:]
 	}
+	msg = expandStackTraces(msg, r)
 	level := strings.ToUpper(logInfo[0])
 	time := time.Now().Format(timeFormat)
 
 	return time, level, msg
 }
 
-func generateESLog(tagMap map[string]string, level string, msg string, logs [][]byte, esLogsSize *uint64) [][]byte {
-
-	data := make(map[string]interface{})
-	for k, v := range tagMap {
-		data[k] = v
+// generateESLog encodes one document, with its bulk action line, straight
+// into the bulk body.
+func generateESLog(config *Config, level string, msg string, esLogs *bulkBody) {
+	// data streams only accept create actions
+	action := "{\"index\":{}}\n"
+	if config.DataStream {
+		action = "{\"create\":{}}\n"
 	}
-	data["level"] = level
-	data["message"] = msg
-	data["time"] = time.Now().Unix() * 1000
 
-	jsonStr, err := json.Marshal(data)
-	if err != nil {
-		log.Print(err)
-		return logs
-	}
-
-	logs = append(logs, jsonStr)
-	//fmt.Println(string(jsonStr))
-	*esLogsSize += uint64(len(jsonStr))
+	esLogs.buf = appendBulkDoc(esLogs.buf, action, config.encodedTags, level, msg, time.Now().Unix()*1000, config.DataStream)
+	esLogs.docs++
+}
 
-	return logs
+// formatIndexName expands date patterns in an index name: %Y year, %y two
+// digit year, %m month, %d day, %H hour, %M minute and %% a literal %.
+func formatIndexName(name string, t time.Time) string {
+	replacer := strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%y", t.Format("06"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%%", "%",
+	)
+	return replacer.Replace(name)
 }
 
-func sendToElasticSearch(config *Config, esConfig SnappyFlowKeyData, logs [][]byte) {
+// bulkURL returns the _bulk endpoint of the target index. Without index_name
+// the SnappyFlow index of the project is used, which still takes a doc type.
+func bulkURL(config *Config, esConfig *ESTarget) string {
+	index := strings.ToLower(formatIndexName(config.IndexName, time.Now().UTC()))
+	docType := config.DocType
+	if config.IndexName == "" {
+		index = strings.ToLower(fmt.Sprintf("log-%s-%s_write", esConfig.ProfileID, GetAPMName(config.ProjectName)))
+		if docType == "" {
+			docType = "doc"
+		}
+	}
 
-	index := strings.ToLower(fmt.Sprintf("log-%s-%s", esConfig.ProfileID, GetAPMName(config.ProjectName)))
 	esPath := fmt.Sprintf("%s://%s:%s/%s", esConfig.Protocol, esConfig.Host, strconv.Itoa(esConfig.Port), index)
+	if docType != "" {
+		esPath += "/" + docType
+	}
+	return esPath + "/_bulk"
+}
+
+// setAuth adds the configured credentials to the request. Only one of
+// api_key, bearer_token or username/password is set, see checkConfigValidity.
+func (t *ESTarget) setAuth(req *http.Request) {
+	switch {
+	case t.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+t.APIKey)
+	case t.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+t.BearerToken)
+	case t.Username != "":
+		req.SetBasicAuth(t.Username, t.Password)
+	}
+}
+
+// sendToElasticSearch sends a bulk of documents generated from the template
+// file template.
+func sendToElasticSearch(config *Config, esConfig *ESTarget, template string, logs *bulkBody) {
 
-	esUrl := esPath + "_write/doc/_bulk"
-	//fmt.Println(index)
+	esUrl := bulkURL(config, esConfig)
 	//fmt.Println(esUrl)
-	noOfLogs := len(logs)
+	noOfLogs := logs.docs
 	if noOfLogs == 0 {
 		fmt.Println("No Logs")
 		return
 	}
 
-	fmt.Println("Current time is %s", time.Now())
-	fmt.Println("logs being sent are", logs)
-
-	var esData []byte
-	for _, elem := range logs {
-		esData = append(esData, "{\"index\":{}}\n"...)
-		esData = append(esData, elem...)
-		esData = append(esData, "\n"...)
-	}
-	esData = append(esData, "\n"...)
-
 	//fmt.Printf("No of records to be sent %d\n", len(logs))
-	req, err := http.NewRequest("POST", esUrl, bytes.NewBuffer(esData))
+	body, contentEncoding, wait := compressStream(config.Compression, logs.buf)
+	defer wait()
+
+	req, err := http.NewRequest("POST", esUrl, body)
 	if err != nil {
 		fmt.Println(err)
+		esConfig.stats.drop(noOfLogs, len(logs.buf))
+		esConfig.stats.fail("request", noOfLogs)
+		esConfig.stats.countTemplate(template, noOfLogs, noOfLogs)
 		return
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(esConfig.Username, esConfig.Password)
-
-	client := &http.Client{Timeout: 30 * time.Second}
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	esConfig.setAuth(req)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), connTrace))
 
-	res, err := client.Do(req)
+	start := esConfig.stats.begin()
+	res, err := esConfig.client.Do(req)
 	if err != nil {
 		fmt.Println(err)
+		esConfig.stats.done(start, noOfLogs, noOfLogs, len(logs.buf))
+		esConfig.stats.fail("transport", noOfLogs)
+		esConfig.stats.countTemplate(template, noOfLogs, noOfLogs)
 		return
 	}
 	defer res.Body.Close()
-	if res.StatusCode == 200 {
-		fmt.Printf("Successfully sent %d records to ES: %s \n", noOfLogs, esUrl)
-	} else {
+	// drain the response so the connection goes back to the pool
+	defer io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode != 200 {
 		fmt.Println("Failed to send ES documents", res.Status)
+		esConfig.stats.done(start, noOfLogs, noOfLogs, len(logs.buf))
+		esConfig.stats.fail(fmt.Sprintf("http %d", res.StatusCode), noOfLogs)
+		esConfig.stats.countTemplate(template, noOfLogs, noOfLogs)
+		return
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		fmt.Println(err)
+		esConfig.stats.done(start, noOfLogs, noOfLogs, len(logs.buf))
+		esConfig.stats.fail("response", noOfLogs)
+		esConfig.stats.countTemplate(template, noOfLogs, noOfLogs)
+		return
+	}
+	countSent(len(logs.buf), wait())
+
+	failed := 0
+	for kind, n := range result.failures() {
+		failed += n
+		esConfig.stats.fail(kind, n)
+	}
+	esConfig.stats.done(start, noOfLogs, failed, len(logs.buf))
+	esConfig.stats.countTemplate(template, noOfLogs, failed)
+	if failed > 0 {
+		fmt.Printf("Failed to send %d of %d ES documents\n", failed, noOfLogs)
 	}
 }
 
-func LoadConfig(path string) (*Config, error) {
-	data, err := ioutil.ReadFile(path)
+func LoadConfig(path string, o overrides) (*Config, error) {
+	data, err := readConfigFile(path, o)
 	if err != nil {
 		return nil, err
 	}
@@ -393,13 +577,65 @@ func checkConfigValidity(config *Config, timesFormats map[string]bool) error {
 		return errors.New("Invalid time format. Please select from above valid formats")
 	}
 
-	if config.ESSend && config.ESKey == "" {
-		return errors.New("Elastic Search key is not provided")
+	if errs := configErrors(config); len(errs) > 0 {
+		return errs[0]
 	}
 
 	return nil
 }
 
+// configErrors returns every problem of the config apart from the time
+// format, in the order checkConfigValidity reports them.
+func configErrors(config *Config) []error {
+	var errs []error
+
+	if target := config.ESTarget; target != nil {
+		if target.Host == "" || target.Port == 0 {
+			errs = append(errs, errors.New("es_target needs host and port"))
+		}
+
+		if target.Protocol != "" && target.Protocol != "http" && target.Protocol != "https" {
+			errs = append(errs, errors.New("es_target protocol has to be either http or https"))
+		}
+
+		auths := 0
+		for _, set := range []bool{target.APIKey != "", target.BearerToken != "", target.Username != ""} {
+			if set {
+				auths++
+			}
+		}
+		if auths > 1 {
+			errs = append(errs, errors.New("es_target accepts only one of api_key, bearer_token or username/password"))
+		}
+
+		if target.ProfileID == "" && config.IndexName == "" {
+			errs = append(errs, errors.New("index_name is needed when es_target has no profile_id"))
+		}
+	}
+
+	if config.DataStream && config.IndexName == "" {
+		errs = append(errs, errors.New("index_name of the data stream is not provided"))
+	}
+
+	if err := checkCompression(config.Compression); err != nil {
+		errs = append(errs, err)
+	}
+
+	if config.Bootstrap != nil && config.Bootstrap.TemplateName == "" {
+		errs = append(errs, errors.New("bootstrap needs a template_name"))
+	}
+
+	if config.DataStream && config.DocType != "" {
+		errs = append(errs, errors.New("doc_type can not be used with data streams"))
+	}
+
+	if err := config.Thresholds.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
 func rotateLogFile(filePath string, config *Config) error {
 	var f, err = os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	stat, err := f.Stat()
@@ -415,7 +651,7 @@ func rotateLogFile(filePath string, config *Config) error {
 	//fmt.Printf("File size in megabytes %f\n", megabytes)
 
 	if megabytes > 0.0 && megabytes >= (float64)(config.FileSizeRotate) {
-		fmt.Printf("File size in MB: %f, config file size:%d \n", megabytes, config.FileSizeRotate)
+		progressf("File size in MB: %f, config file size:%d \n", megabytes, config.FileSizeRotate)
 		log := log.New(f, "", log.Ldate|log.Ltime)
 
 		l := &lumberjack.Logger{
@@ -430,39 +666,221 @@ func rotateLogFile(filePath string, config *Config) error {
 	return nil
 }
 
-func main() {
-	args := os.Args
-
-	if len(args) < 3 {
-		fmt.Println("Insufficient arguments")
-		return
-	}
-
-	config, err := LoadConfig(args[1])
+// setupGenerator loads and checks the config and reads the log templates,
+// args being the config file followed by the template files. name is the
+// definition name, empty for a single config.
+func setupGenerator(name string, args []string, o overrides) (*Config, [][][]string, error) {
+	config, err := LoadConfig(args[0], o)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, nil, err
+	}
+	if name != "" {
+		resolveTemplateFiles(config, filepath.Dir(args[0]))
+		config.definition = name
 	}
 
 	var timeFormats = make(map[string]bool)
 	setTimeFormats(timeFormats)
 
 	if err := checkConfigValidity(config, timeFormats); err != nil {
-		fmt.Println(err)
-		return
+		return nil, nil, err
+	}
+
+	config.encodedTags = encodeTags(config.Tags)
+	// template_files are used along with the template files in args
+	files := append(append([]string{}, args...), config.TemplateFiles...)
+	// processLogTemlates exits on files it can not open
+	for _, path := range files[1:] {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		file.Close()
+	}
+	logTemplates, names := processLogTemlates(files)
+	if len(logTemplates) == 0 {
+		return nil, nil, errors.New("No log templates, pass template files as arguments or set 'template_files'")
+	}
+	config.templateNames = names
+	return config, logTemplates, nil
+}
+
+// runOptions are the run command flags that are not config fields.
+type runOptions struct {
+	seed          int64
+	statsInterval time.Duration
+	// duration ends the run, which otherwise runs until interrupted
+	duration time.Duration
+	// metricsAddr is the listen address of the /metrics endpoint, if any
+	metricsAddr string
+	// report is the file the JSON run report is written to, if any
+	report string
+	// controlAddr is the listen address of the control API, if any
+	controlAddr string
+	// overrides are applied again on reload, watch reloads when the config
+	// or template files change
+	overrides overrides
+	watch     bool
+	// stop ends the run like an interrupt, done is handed the report of the
+	// run, both are set for workers of a distributed run
+	stop <-chan struct{}
+	done func(report *runReport)
+}
+
+// stopSignal returns a channel that is closed on SIGINT or SIGTERM, once
+// duration has passed if it is not 0, or when also is closed.
+func stopSignal(duration time.Duration, also <-chan struct{}) <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		var timeout <-chan time.Time
+		if duration > 0 {
+			timeout = time.After(duration)
+		}
+		select {
+		case <-signals:
+		case <-timeout:
+		case <-also:
+		}
+		// a second interrupt kills the process
+		signal.Stop(signals)
+		close(stop)
+	}()
+	return stop
+}
+
+// connect returns the Elasticsearch target of the config with its client
+// and stats, nil if es_send is not set.
+func connect(config *Config) (*ESTarget, error) {
+	if !config.ESSend {
+		return nil, nil
+	}
+	if config.ESKey == "" && config.ESTarget == nil {
+		return nil, errors.New("Elastic Search key or es_target is not provided")
+	}
+
+	esConfig := config.ESTarget
+	if esConfig == nil {
+		keyData, err := createTargetsFromKey(config)
+		if err != nil {
+			return nil, errors.New("Decryption Failed")
+		}
+		esConfig = &ESTarget{
+			Host:      keyData.Host,
+			Port:      keyData.Port,
+			Protocol:  keyData.Protocol,
+			ProfileID: keyData.ProfileID,
+			Username:  keyData.Username,
+			Password:  keyData.Password,
+		}
+	}
+	if esConfig.Protocol == "" {
+		esConfig.Protocol = "http"
 	}
 
-	var esConfig SnappyFlowKeyData
-	logTemplates := processLogTemlates(args)
-	if config.ESSend == true {
-		esConfig, err = createTargetsFromKey(config)
-		fmt.Println(esConfig)
+	client, err := clientFor(esConfig, config.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+	esConfig.client = client
+	esConfig.stats = newSinkStats(config.sinkName("es", fmt.Sprintf("%s:%d", esConfig.Host, esConfig.Port)))
+	fmt.Printf("Sending logs to %s://%s:%d\n", esConfig.Protocol, esConfig.Host, esConfig.Port)
+	return esConfig, nil
+}
+
+// runGenerator connects to the Elasticsearch target of every generator,
+// bootstraps it if asked and generates logs, printing the status of every
+// sink each statsInterval, until the run is stopped. It then prints the
+// summary of the run, checks the thresholds and writes the run report if
+// asked.
+func runGenerator(gens []*generator, opts runOptions) error {
+	esConfigs := make([]*ESTarget, len(gens))
+	for i, g := range gens {
+		config := g.config
+		esConfig, err := connect(config)
 		if err != nil {
-			fmt.Println("Decryption Failed")
-			return
+			return err
+		}
+		esConfigs[i] = esConfig
+
+		if config.ESSend && config.Bootstrap != nil {
+			if err := bootstrapElasticSearch(config, esConfig); err != nil {
+				return err
+			}
+		}
+
+		if config.FileWrite {
+			config.fileStats = newSinkStats(config.sinkName("file", config.FileName))
+		}
+		setRunning(config)
+	}
+	if opts.metricsAddr != "" {
+		if err := serveMetrics(opts.metricsAddr); err != nil {
+			return err
 		}
 	}
 
-	startLogGeneration(config, esConfig, logTemplates)
+	if opts.controlAddr != "" {
+		if err := serveControl(opts.controlAddr); err != nil {
+			return err
+		}
+	}
+
+	stop := stopSignal(opts.duration, opts.stop)
+	if !quiet && opts.statsInterval > 0 {
+		go reportStatus(opts.statsInterval, stop)
+	}
 
+	fmt.Printf("Using seed %d\n", opts.seed)
+	if len(gens) > 1 || gens[0].name != "" {
+		fmt.Printf("Running %d definitions\n", len(gens))
+	}
+
+	start := time.Now()
+	rounds := make([]int, len(gens))
+	var generators sync.WaitGroup
+	for i, g := range gens {
+		reloads := watchConfig(g, opts.overrides, opts.watch, stop)
+		generators.Add(1)
+		go func(i int, g *generator) {
+			defer generators.Done()
+			rounds[i] = startLogGeneration(g, esConfigs[i], definitionSeed(opts.seed, g.name), reloads, stop)
+		}(i, g)
+	}
+	generators.Wait()
+	end := time.Now()
+	printSummary(end.Sub(start))
+
+	// reloads swap the running configs
+	for i, config := range runningConfigs() {
+		gens[i].config = config
+	}
+
+	report := buildReport(gens, opts.seed, start, end, rounds)
+	report.Thresholds = checkThresholds(gens, report)
+	for _, g := range gens {
+		if g.config.Thresholds != nil {
+			printThresholds(report.Thresholds)
+			break
+		}
+	}
+	if opts.done != nil {
+		opts.done(report)
+	}
+	if opts.report != "" {
+		if err := writeReport(opts.report, report); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote run report to %s\n", opts.report)
+	}
+	if !report.Thresholds.Passed {
+		return errThresholdsViolated
+	}
+	return nil
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatIndexName(t *testing.T) {
+	at := time.Date(2024, time.March, 7, 9, 5, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"logs", "logs"},
+		{"logs-app-%Y.%m.%d", "logs-app-2024.03.07"},
+		{"logs-%y%m%d-%H%M", "logs-240307-0905"},
+		{"100%%-%Y", "100%-2024"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := formatIndexName(tt.name, at); got != tt.want {
+			t.Errorf("formatIndexName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
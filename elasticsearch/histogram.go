@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// The latency histogram keeps histSub linear buckets per power of two of
+// nanoseconds, so any recorded value is off by less than 1/histSub (1.6%),
+// from nanoseconds up to histMax.
+const (
+	histSubBits  = 6
+	histSub      = 1 << histSubBits
+	histMaxBits  = 42 // about 73 minutes
+	histMax      = 1<<histMaxBits - 1
+	histMaxShift = histMaxBits - histSubBits - 1
+	histBuckets  = (histMaxShift + 2) * histSub
+)
+
+// histogram records durations, or other values with recordValue. record is
+// safe for concurrent use, reads go through snapshot.
+type histogram struct {
+	counts [histBuckets]uint64
+	total  uint64
+	sum    uint64
+	max    uint64
+	// intervalMax is the max since the last snapshot
+	intervalMax uint64
+}
+
+func histIndex(v uint64) int {
+	if v > histMax {
+		v = histMax
+	}
+	shift := 0
+	if n := bits.Len64(v) - histSubBits - 1; n > 0 {
+		shift = n
+	}
+	return shift*histSub + int(v>>uint(shift))
+}
+
+// histValue returns the highest value that falls into bucket i.
+func histValue(i int) uint64 {
+	if i < 2*histSub {
+		return uint64(i)
+	}
+	shift := uint(i/histSub - 1)
+	mantissa := uint64(i - int(shift)*histSub)
+	return (mantissa+1)<<shift - 1
+}
+
+func storeMax(addr *uint64, v uint64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if v <= old || atomic.CompareAndSwapUint64(addr, old, v) {
+			return
+		}
+	}
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.recordValue(uint64(d))
+}
+
+func (h *histogram) recordValue(v uint64) {
+	atomic.AddUint64(&h.counts[histIndex(v)], 1)
+	atomic.AddUint64(&h.total, 1)
+	atomic.AddUint64(&h.sum, v)
+	storeMax(&h.max, v)
+	storeMax(&h.intervalMax, v)
+}
+
+// histSnapshot is a copy of a histogram, or the difference of two copies.
+type histSnapshot struct {
+	counts [histBuckets]uint64
+	total  uint64
+	sum    uint64
+	max    uint64
+}
+
+// snapshot copies the histogram. Its max is the max since the previous
+// snapshot, so the difference to the previous snapshot describes an interval.
+func (h *histogram) snapshot() *histSnapshot {
+	s := &histSnapshot{sum: atomic.LoadUint64(&h.sum), max: atomic.SwapUint64(&h.intervalMax, 0)}
+	for i := range h.counts {
+		s.counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.total += s.counts[i]
+	}
+	return s
+}
+
+// whole returns a snapshot of everything recorded so far.
+func (h *histogram) whole() *histSnapshot {
+	s := &histSnapshot{sum: atomic.LoadUint64(&h.sum), max: atomic.LoadUint64(&h.max)}
+	for i := range h.counts {
+		s.counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.total += s.counts[i]
+	}
+	return s
+}
+
+// load replaces what the histogram recorded with s, for values recorded by
+// another process.
+func (h *histogram) load(s *histSnapshot) {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], s.counts[i])
+	}
+	atomic.StoreUint64(&h.total, s.total)
+	atomic.StoreUint64(&h.sum, s.sum)
+	atomic.StoreUint64(&h.max, s.max)
+	storeMax(&h.intervalMax, s.max)
+}
+
+// since returns what was recorded between prev and s, keeping the max of s.
+func (s *histSnapshot) since(prev *histSnapshot) *histSnapshot {
+	if prev == nil {
+		prev = &histSnapshot{}
+	}
+	d := &histSnapshot{sum: s.sum - prev.sum, max: s.max}
+	for i := range s.counts {
+		d.counts[i] = s.counts[i] - prev.counts[i]
+		d.total += d.counts[i]
+	}
+	return d
+}
+
+// merge returns the values recorded in s and o together.
+func (s *histSnapshot) merge(o *histSnapshot) *histSnapshot {
+	m := &histSnapshot{total: s.total + o.total, sum: s.sum + o.sum, max: s.max}
+	if o.max > m.max {
+		m.max = o.max
+	}
+	for i := range s.counts {
+		m.counts[i] = s.counts[i] + o.counts[i]
+	}
+	return m
+}
+
+// quantile returns the value below which the fraction q of the recorded
+// values fall, 0 if nothing was recorded.
+func (s *histSnapshot) quantile(q float64) time.Duration {
+	if s.total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(s.total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range s.counts {
+		seen += c
+		if seen >= rank {
+			v := histValue(i)
+			// the max is exact, the buckets are not
+			if v > s.max {
+				v = s.max
+			}
+			return time.Duration(v)
+		}
+	}
+	return time.Duration(s.max)
+}
+
+// cumulative returns the number of values at or below each of the sorted
+// bounds, as far as the buckets tell.
+func (s *histSnapshot) cumulative(bounds []uint64) []uint64 {
+	counts := make([]uint64, len(bounds))
+	var seen uint64
+	b := 0
+	for i, c := range s.counts {
+		for b < len(bounds) && histValue(i) > bounds[b] {
+			counts[b] = seen
+			b++
+		}
+		if b == len(bounds) {
+			break
+		}
+		seen += c
+	}
+	for ; b < len(bounds); b++ {
+		counts[b] = seen
+	}
+	return counts
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPClientConfig tunes the connection pool of the client shared by all
+// requests to a target. Timeouts are in seconds.
+type HTTPClientConfig struct {
+	MaxConnsPerHost     int     `json:"max_conns_per_host"`
+	MaxIdleConnsPerHost int     `json:"max_idle_conns_per_host"`
+	IdleConnTimeout     float64 `json:"idle_conn_timeout"`
+	RequestTimeout      float64 `json:"request_timeout"`
+	HTTP2               bool    `json:"http2"`
+}
+
+// Connections handed out by the pool, split by whether they were reused.
+var newConns, reusedConns uint64
+
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		if info.Reused {
+			atomic.AddUint64(&reusedConns, 1)
+		} else {
+			atomic.AddUint64(&newConns, 1)
+		}
+	},
+}
+
+func (c HTTPClientConfig) newClient(tlsConfig *tls.Config) *http.Client {
+	requestTimeout := 30 * time.Second
+	if c.RequestTimeout > 0 {
+		requestTimeout = time.Duration(c.RequestTimeout * float64(time.Second))
+	}
+	idleConnTimeout := 90 * time.Second
+	if c.IdleConnTimeout > 0 {
+		idleConnTimeout = time.Duration(c.IdleConnTimeout * float64(time.Second))
+	}
+	maxIdleConnsPerHost := c.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = 100
+	}
+
+	// keep the proxy, dial and TLS handshake timeouts of the default transport
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+	transport.MaxIdleConns = maxIdleConnsPerHost
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.ForceAttemptHTTP2 = c.HTTP2
+	if !c.HTTP2 {
+		// a non-nil empty map keeps the transport on HTTP/1.1
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &http.Client{Timeout: requestTimeout, Transport: transport}
+}
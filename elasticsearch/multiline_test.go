@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestContinuation(t *testing.T) {
+	tests := []struct {
+		line string
+		text string
+		ok   bool
+	}{
+		{"level=info, message = started", "", false},
+		{"", "", false},
+		{" ", "", false},
+		{"\t\r\n", "", false},
+		{" ValueError: bad value\n", "ValueError: bad value", true},
+		{"  File \"/srv/app.py\", line 3\n", " File \"/srv/app.py\", line 3", true},
+		{"\tat com.acme.Foo.bar(Foo.java:42)\r\n", "\tat com.acme.Foo.bar(Foo.java:42)", true},
+		{"  level=error, message = indented template", "", false},
+		{"\tLEVEL = warn, message = indented template", "", false},
+		{" level of detail too high", "level of detail too high", true},
+	}
+	for _, tt := range tests {
+		text, ok := continuation(tt.line)
+		if text != tt.text || ok != tt.ok {
+			t.Errorf("continuation(%q) = %q, %v, want %q, %v", tt.line, text, ok, tt.text, tt.ok)
+		}
+	}
+}
+
+func TestExpandStackTraces(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		msg    string
+		prefix string
+		starts string
+	}{
+		{"Request failed$JAVA_STACK", "Request failed\n", "java."},
+		{"Task failed$PYTHON_STACK", "Task failed\n", "Traceback (most recent call last):"},
+		{"Handler crashed$GO_STACK", "Handler crashed\n", "panic: "},
+	}
+	for _, tt := range tests {
+		got := expandStackTraces(tt.msg, r)
+		if !strings.HasPrefix(got, tt.prefix+tt.starts) || strings.Contains(got, "_STACK") {
+			t.Errorf("expandStackTraces(%q) = %q", tt.msg, got)
+		}
+	}
+	if got := expandStackTraces("no trace $INT", r); got != "no trace $INT" {
+		t.Errorf("expandStackTraces changed a message without traces to %q", got)
+	}
+}
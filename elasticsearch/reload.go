@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often -watch looks at the config and template files.
+const watchInterval = 2 * time.Second
+
+// running holds the config of every generator for the metrics and control
+// API, startLogGeneration swaps them on reload.
+var running struct {
+	sync.Mutex
+	configs []*Config
+}
+
+// setRunning makes config the running config of its definition.
+func setRunning(config *Config) {
+	running.Lock()
+	defer running.Unlock()
+	for i, c := range running.configs {
+		if c.definition == config.definition {
+			running.configs[i] = config
+			return
+		}
+	}
+	running.configs = append(running.configs, config)
+}
+
+// runningConfigs returns the running config of every generator in the
+// order they were started.
+func runningConfigs() []*Config {
+	running.Lock()
+	defer running.Unlock()
+	return append([]*Config{}, running.configs...)
+}
+
+// swapConfig keeps the connection to the ES target and the file sink of
+// current in loaded and makes it the running config. Rounds after the swap
+// use loaded.
+func swapConfig(current *Config, loaded *generator) {
+	config := loaded.config
+	if connection(config) != connection(current) {
+		fmt.Println("es_send, es_key, es_target, http_client and bootstrap changes are only picked up by a new run")
+	}
+	config.ESSend, config.ESKey, config.ESTarget = current.ESSend, current.ESKey, current.ESTarget
+	config.HTTPClient, config.Bootstrap = current.HTTPClient, current.Bootstrap
+
+	// no round is running, so the file sink can be set
+	if current.fileStats != nil && config.FileName == current.FileName {
+		config.fileStats = current.fileStats
+	} else if config.FileWrite {
+		config.fileStats = newSinkStats(config.sinkName("file", config.FileName))
+	}
+	setRunning(config)
+}
+
+// connection returns the settings of the connection to the ES target as
+// written in the config.
+func connection(config *Config) string {
+	var target ESTarget
+	if config.ESTarget != nil {
+		target = *config.ESTarget
+	}
+	// runGenerator defaults the protocol of the running target
+	if target.Protocol == "" {
+		target.Protocol = "http"
+	}
+	data, _ := json.Marshal([]interface{}{config.ESSend, config.ESKey, target, config.HTTPClient, config.Bootstrap})
+	return string(data)
+}
+
+// modTimes returns the modification time of every file, zero for files that
+// can not be read.
+func modTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			times[file] = info.ModTime()
+		} else {
+			times[file] = time.Time{}
+		}
+	}
+	return times
+}
+
+// watchConfig reloads the config and template files of g on SIGHUP, and
+// whenever they change if watch is set, until stop is closed. Generators
+// that pass the checks are sent on the returned channel, the others are
+// reported and dropped.
+func watchConfig(g *generator, o overrides, watch bool, stop <-chan struct{}) <-chan *generator {
+	reloads := make(chan *generator, 1)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hangup)
+		var tick <-chan time.Time
+		if watch {
+			ticker := time.NewTicker(watchInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		files := g.watchedFiles()
+		times := modTimes(files)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-hangup:
+				fmt.Printf("Reloading %s on SIGHUP\n", g.args[0])
+			case <-tick:
+				current := modTimes(files)
+				if reflect.DeepEqual(current, times) {
+					continue
+				}
+				times = current
+				fmt.Printf("Config or template files of %s changed, reloading\n", g.args[0])
+			}
+
+			if p := validateFiles(g.name, g.args[0], g.args[1:], o); p.failed() > 0 {
+				for _, problem := range p {
+					fmt.Println(problem)
+				}
+				fmt.Printf("Reload of %s failed validation, keeping the running config\n", g.args[0])
+				continue
+			}
+			loaded, err := loadGenerator(g.name, g.args, o)
+			if err != nil {
+				fmt.Printf("Reload of %s failed, keeping the running config: %v\n", g.args[0], err)
+				continue
+			}
+			g = loaded
+			files = g.watchedFiles()
+			times = modTimes(files)
+
+			// a newer config replaces one that was not picked up yet
+			select {
+			case <-reloads:
+			default:
+			}
+			reloads <- loaded
+		}
+	}()
+	return reloads
+}
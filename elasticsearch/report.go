@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runReport is the JSON report of a run written by -report. Maps are keyed
+// by name so reports of different runs can be diffed.
+type runReport struct {
+	ConfigDigest   string                  `json:"config_digest"`
+	Seed           int64                   `json:"seed"`
+	Start          time.Time               `json:"start"`
+	End            time.Time               `json:"end"`
+	ElapsedSeconds float64                 `json:"elapsed_seconds"`
+	Sinks          map[string]*sinkReport  `json:"sinks"`
+	Rate           *rateReport             `json:"rate"`
+	Generated      *countReport            `json:"generated"`
+	Templates      map[string]*countReport `json:"templates"`
+	Levels         map[string]*countReport `json:"levels"`
+	Thresholds     *thresholdReport        `json:"thresholds"`
+	// Definitions is only set for a definitions directory run, Rate and
+	// Generated then sum up all definitions
+	Definitions map[string]*definitionReport `json:"definitions,omitempty"`
+	// Workers is only set for a distributed run
+	Workers []*workerReport `json:"workers,omitempty"`
+}
+
+// definitionReport holds the rate and generated counts of a definition. Its
+// sinks are those prefixed by its name.
+type definitionReport struct {
+	ConfigDigest string       `json:"config_digest"`
+	Rate         *rateReport  `json:"rate"`
+	Generated    *countReport `json:"generated"`
+}
+
+type sinkReport struct {
+	Sent         uint64                    `json:"sent"`
+	Failed       uint64                    `json:"failed"`
+	Dropped      uint64                    `json:"dropped"`
+	Bytes        uint64                    `json:"bytes"`
+	DroppedBytes uint64                    `json:"dropped_bytes"`
+	Errors       map[string]uint64         `json:"errors"`
+	Latency      map[string]*latencyReport `json:"latency"`
+}
+
+// latencyReport holds the request latency of an outcome in milliseconds.
+type latencyReport struct {
+	Requests  uint64             `json:"requests"`
+	Quantiles map[string]float64 `json:"quantiles_ms"`
+	Max       float64            `json:"max_ms"`
+}
+
+// rateReport compares the records generated per second with logs_per_min.
+type rateReport struct {
+	Target    float64 `json:"target_per_second"`
+	Actual    float64 `json:"actual_per_second"`
+	Adherence float64 `json:"adherence"`
+}
+
+type countReport struct {
+	Records uint64 `json:"records"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func (c *countReport) add(n genCount) {
+	c.Records += n.records
+	c.Bytes += n.bytes
+}
+
+func addCount(m map[string]*countReport, key string, n genCount) {
+	if m[key] == nil {
+		m[key] = &countReport{}
+	}
+	m[key].add(n)
+}
+
+// configDigest returns the sha256 of the config as it was run, after
+// overrides.
+func configDigest(config *Config) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func latencyOf(h *histSnapshot) *latencyReport {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	l := &latencyReport{Requests: h.total, Quantiles: make(map[string]float64), Max: ms(time.Duration(h.max))}
+	for _, q := range latencyQuantiles {
+		l.Quantiles[q.name] = ms(h.quantile(q.q))
+	}
+	return l
+}
+
+// buildReport collects the statistics of a run from start to end in which
+// every generator generated rounds rounds of logs.
+func buildReport(gens []*generator, seed int64, start, end time.Time, rounds []int) *runReport {
+	report := &runReport{
+		ConfigDigest:   digest(gens),
+		Seed:           seed,
+		Start:          start,
+		End:            end,
+		ElapsedSeconds: end.Sub(start).Seconds(),
+		Sinks:          make(map[string]*sinkReport),
+		Generated:      &countReport{},
+		Templates:      make(map[string]*countReport),
+		Levels:         make(map[string]*countReport),
+	}
+
+	for _, s := range allSinks() {
+		sink := &sinkReport{
+			Sent:         atomic.LoadUint64(&s.sent),
+			Failed:       atomic.LoadUint64(&s.failed),
+			Dropped:      atomic.LoadUint64(&s.dropped),
+			Bytes:        atomic.LoadUint64(&s.bytes),
+			DroppedBytes: atomic.LoadUint64(&s.droppedBytes),
+			Errors:       s.errorCounts(),
+			Latency:      make(map[string]*latencyReport),
+		}
+		all := &histSnapshot{}
+		for outcome := 0; outcome < outcomes; outcome++ {
+			h := s.latency[outcome].whole()
+			all = all.merge(h)
+			if h.total > 0 {
+				sink.Latency[outcomeNames[outcome]] = latencyOf(h)
+			}
+		}
+		if all.total > 0 {
+			sink.Latency["all"] = latencyOf(all)
+		}
+		report.Sinks[s.name] = sink
+	}
+
+	generated := make(map[string]*countReport)
+	for key, n := range generatedCounts() {
+		report.Generated.add(n)
+		addCount(generated, key.definition, n)
+		addCount(report.Templates, key.template, n)
+		addCount(report.Levels, key.level, n)
+	}
+
+	definitions := make(map[string]*definitionReport, len(gens))
+	report.Rate = &rateReport{}
+	for i, g := range gens {
+		def := &definitionReport{ConfigDigest: configDigest(g.config), Generated: generated[g.name]}
+		if def.Generated == nil {
+			def.Generated = &countReport{}
+		}
+		// a round generates the logs of a whole log_interval at its start,
+		// so the rate is measured over the intervals of all rounds unless
+		// they took longer than that
+		seconds := math.Max(report.ElapsedSeconds, float64(rounds[i])*g.config.LogInterval)
+		def.Rate = &rateReport{
+			Target: float64(control.logsPerMin(g.config)) / 60,
+			Actual: float64(def.Generated.Records) / seconds,
+		}
+		if def.Rate.Target > 0 {
+			def.Rate.Adherence = def.Rate.Actual / def.Rate.Target
+		}
+		definitions[g.name] = def
+		report.Rate.Target += def.Rate.Target
+		report.Rate.Actual += def.Rate.Actual
+	}
+	if report.Rate.Target > 0 {
+		report.Rate.Adherence = report.Rate.Actual / report.Rate.Target
+	}
+	if len(gens) > 1 || gens[0].name != "" {
+		report.Definitions = definitions
+	}
+	return report
+}
+
+// inDefinition tells whether the sink called sinkName, "<kind> <target>",
+// belongs to the definition name, its target being prefixed by the name.
+func inDefinition(sinkName string, name string) bool {
+	i := strings.Index(sinkName, " ")
+	return i >= 0 && strings.HasPrefix(sinkName[i+1:], name+"/")
+}
+
+// forDefinition returns the part of the report about the definition name,
+// all of it for a single config.
+func (report *runReport) forDefinition(name string) *runReport {
+	if name == "" {
+		return report
+	}
+	sub := *report
+	sub.Sinks = make(map[string]*sinkReport)
+	for sinkName, sink := range report.Sinks {
+		if inDefinition(sinkName, name) {
+			sub.Sinks[sinkName] = sink
+		}
+	}
+	sub.Rate = report.Definitions[name].Rate
+	sub.Generated = report.Definitions[name].Generated
+	return &sub
+}
+
+// writeReport writes the report as indented JSON to path.
+func writeReport(path string, report *runReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestSeedFlag(t *testing.T) {
+	var f seedFlag
+	if f.String() != "" {
+		t.Errorf("unset flag = %q, want empty", f.String())
+	}
+	for _, s := range []string{"0", "-1", "42", "9223372036854775807"} {
+		f = seedFlag{}
+		if err := f.Set(s); err != nil {
+			t.Fatalf("Set(%s): %v", s, err)
+		}
+		if got := f.String(); got != s {
+			t.Errorf("Set(%s) = %s", s, got)
+		}
+	}
+	f = seedFlag{}
+	f.Set("0")
+	if f.value() != 0 {
+		t.Errorf("value of -seed 0 = %d, want 0", f.value())
+	}
+	if err := f.Set("x"); err == nil {
+		t.Error("Set(x) accepted")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestCountTemplate(t *testing.T) {
+	s := newSinkStats("es")
+	s.countTemplate("logTemp1", 10, 3)
+	s.countTemplate("logTemp1", 5, 0)
+	s.countTemplate("logTemp2", 1, 1)
+
+	counts := s.templateCounts()
+	if got, want := counts["logTemp1"], (templateCount{Sent: 12, Failed: 3}); got != want {
+		t.Errorf("logTemp1 = %+v, want %+v", got, want)
+	}
+	if got, want := counts["logTemp2"], (templateCount{Sent: 0, Failed: 1}); got != want {
+		t.Errorf("logTemp2 = %+v, want %+v", got, want)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	if got := labels(); got != "" {
+		t.Errorf("labels() = %q, want empty", got)
+	}
+	if got, want := labels("sink", "a\"b", "template", "t"), `{sink="a\"b",template="t"}`; got != want {
+		t.Errorf("labels = %s, want %s", got, want)
+	}
+}
+
+func TestGenTally(t *testing.T) {
+	key := genKey{definition: "tally", template: "logTemp1", level: "info"}
+	tally := make(genTally)
+	tally.add(key, 10)
+	tally.add(key, 5)
+	if got := generatedCounts()[key]; got.records != 0 {
+		t.Errorf("counted %d records before the flush", got.records)
+	}
+	tally.flush()
+	tally.add(key, 1)
+	tally.flush()
+	tally.flush()
+	if got, want := generatedCounts()[key], (genCount{records: 3, bytes: 16}); got != want {
+		t.Errorf("generated = %+v, want %+v", got, want)
+	}
+}
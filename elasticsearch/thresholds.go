@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// exitThresholds is the exit code of a run that violated its thresholds.
+const exitThresholds = 3
+
+var errThresholdsViolated = errors.New("thresholds violated")
+
+// Thresholds are the pass/fail checks of a run, evaluated on its report when
+// the run stops. Unset thresholds are not checked.
+type Thresholds struct {
+	// MaxErrorRate is the fraction of the records of a sink that may fail
+	// or be dropped, e.g. 0.001
+	MaxErrorRate *float64 `json:"max_error_rate"`
+	// MaxLatencyMs is the request latency of every sink by quantile (p50,
+	// p90, p99, p99.9 or max) in milliseconds
+	MaxLatencyMs map[string]float64 `json:"max_latency_ms"`
+	// MinRateAdherence is the fraction of logs_per_min the run has to
+	// reach, e.g. 0.95
+	MinRateAdherence float64 `json:"min_rate_adherence"`
+}
+
+// thresholdReport is the outcome of the threshold checks in the run report.
+type thresholdReport struct {
+	Passed     bool     `json:"passed"`
+	Checks     int      `json:"checks"`
+	Violations []string `json:"violations"`
+}
+
+func (t *Thresholds) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.MaxErrorRate != nil && (*t.MaxErrorRate < 0 || *t.MaxErrorRate > 1) {
+		return fmt.Errorf("thresholds: max_error_rate has to be between 0 and 1, got %v", *t.MaxErrorRate)
+	}
+	for name := range t.MaxLatencyMs {
+		if _, ok := latencyOfQuantile(&latencyReport{}, name); !ok {
+			return fmt.Errorf("thresholds: unknown max_latency_ms quantile %q, use p50, p90, p99, p99.9 or max", name)
+		}
+	}
+	if t.MinRateAdherence < 0 {
+		return fmt.Errorf("thresholds: min_rate_adherence can not be negative, got %v", t.MinRateAdherence)
+	}
+	return nil
+}
+
+// latencyOfQuantile returns the latency of the quantile named name.
+func latencyOfQuantile(l *latencyReport, name string) (float64, bool) {
+	if name == "max" {
+		return l.Max, true
+	}
+	for _, q := range latencyQuantiles {
+		if q.name == name {
+			return l.Quantiles[name], true
+		}
+	}
+	return 0, false
+}
+
+// check evaluates the thresholds on the report of a run.
+func (t *Thresholds) check(report *runReport) *thresholdReport {
+	result := &thresholdReport{Violations: []string{}}
+	if t == nil {
+		result.Passed = true
+		return result
+	}
+	violated := func(format string, a ...interface{}) {
+		result.Violations = append(result.Violations, fmt.Sprintf(format, a...))
+	}
+
+	for _, name := range sortedSinkNames(report.Sinks) {
+		sink := report.Sinks[name]
+		if total := sink.Sent + sink.Failed + sink.Dropped; t.MaxErrorRate != nil && total > 0 {
+			result.Checks++
+			rate := float64(sink.Failed+sink.Dropped) / float64(total)
+			if rate > *t.MaxErrorRate {
+				violated("%s: error rate %.3f%% (%d of %d records) is above max_error_rate %.3f%%",
+					name, rate*100, sink.Failed+sink.Dropped, total, *t.MaxErrorRate*100)
+			}
+		}
+		if all := sink.Latency["all"]; all != nil {
+			for _, q := range sortedQuantiles(t.MaxLatencyMs) {
+				result.Checks++
+				if latency, _ := latencyOfQuantile(all, q); latency > t.MaxLatencyMs[q] {
+					violated("%s: %s latency %s is above max_latency_ms.%s %s", name, q, formatMs(latency), q, formatMs(t.MaxLatencyMs[q]))
+				}
+			}
+		}
+	}
+
+	if rate := report.Rate; t.MinRateAdherence > 0 {
+		result.Checks++
+		if rate.Adherence < t.MinRateAdherence {
+			violated("generated %.1f records/s, %.1f%% of the target %.1f/s, below min_rate_adherence %.1f%%",
+				rate.Actual, rate.Adherence*100, rate.Target, t.MinRateAdherence*100)
+		}
+	}
+
+	result.Passed = len(result.Violations) == 0
+	return result
+}
+
+// checkThresholds evaluates the thresholds of every generator on the part of
+// the report about it.
+func checkThresholds(gens []*generator, report *runReport) *thresholdReport {
+	result := &thresholdReport{Violations: []string{}}
+	for _, g := range gens {
+		r := g.config.Thresholds.check(report.forDefinition(g.name))
+		result.Checks += r.Checks
+		for _, v := range r.Violations {
+			if g.name != "" {
+				v = "definition " + g.name + ": " + v
+			}
+			result.Violations = append(result.Violations, v)
+		}
+	}
+	result.Passed = len(result.Violations) == 0
+	return result
+}
+
+func sortedSinkNames(sinks map[string]*sinkReport) []string {
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedQuantiles(limits map[string]float64) []string {
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatMs(ms float64) string {
+	return formatLatency(time.Duration(ms * float64(time.Millisecond)))
+}
+
+// printThresholds explains the outcome of the threshold checks.
+func printThresholds(result *thresholdReport) {
+	for _, v := range result.Violations {
+		fmt.Println("Threshold violated:", v)
+	}
+	if result.Passed {
+		fmt.Printf("All %d threshold checks passed\n", result.Checks)
+	} else {
+		fmt.Printf("%d of %d threshold checks failed\n", len(result.Violations), result.Checks)
+	}
+}
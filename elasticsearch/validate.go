@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// problems collects validation problems as "file:line: message" entries.
+// Warnings are about input the generator skips or ignores, they are printed
+// but do not fail the validation.
+type problems []problem
+
+type problem struct {
+	text    string
+	warning bool
+}
+
+func (p problem) String() string {
+	return p.text
+}
+
+func (p *problems) add(file string, line int, format string, args ...interface{}) {
+	*p = append(*p, problem{text: location(file, line) + fmt.Sprintf(format, args...)})
+}
+
+func (p *problems) warn(file string, line int, format string, args ...interface{}) {
+	*p = append(*p, problem{text: location(file, line) + "warning: " + fmt.Sprintf(format, args...), warning: true})
+}
+
+// failed returns the number of problems that are not warnings.
+func (p problems) failed() int {
+	n := 0
+	for _, problem := range p {
+		if !problem.warning {
+			n++
+		}
+	}
+	return n
+}
+
+func location(file string, line int) string {
+	if line > 0 {
+		return fmt.Sprintf("%s:%d: ", file, line)
+	}
+	return file + ": "
+}
+
+var knownLevels = map[string]bool{
+	"trace": true, "debug": true, "info": true, "notice": true, "warn": true,
+	"warning": true, "error": true, "critical": true, "fatal": true,
+}
+
+// placeholders are the random values a template message can use.
+var placeholders = []string{"$IP", "$INT", "$JAVA_STACK", "$PYTHON_STACK", "$GO_STACK"}
+
+// kafkaPlaceholders are only replaced by the kafka generator, the
+// elasticsearch generator sends them as written.
+var kafkaPlaceholders = map[string]bool{"$STRING": true}
+
+// runValidate validates the config and template files, or every definition
+// of a definitions directory, prints every problem and returns the exit code.
+func runValidate(configPath string, templatePaths []string, o overrides) int {
+	var p problems
+	for _, path := range templatePaths {
+		validateTemplateFile(path, &p)
+	}
+	if isDefinitionsDir(configPath) {
+		paths, err := definitionFiles(configPath)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, path := range paths {
+			p = append(p, validate(path, true, templatePaths, o)...)
+		}
+	} else {
+		p = append(p, validate(configPath, false, templatePaths, o)...)
+	}
+	for _, problem := range p {
+		fmt.Println(problem)
+	}
+	if n := p.failed(); n > 0 {
+		fmt.Printf("%d problem(s) found\n", n)
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", configPath)
+	return 0
+}
+
+// validateFiles checks a config and the template files passed as arguments
+// the way runValidate does, name is the definition name, empty for a single
+// config.
+func validateFiles(name, configPath string, templatePaths []string, o overrides) problems {
+	var p problems
+	for _, path := range templatePaths {
+		validateTemplateFile(path, &p)
+	}
+	return append(p, validate(configPath, name != "", templatePaths, o)...)
+}
+
+// validate checks a config, the template files passed as arguments are
+// checked by runValidate. definition tells whether the config is in a
+// definitions directory, with template_files relative to the directory.
+func validate(configPath string, definition bool, templatePaths []string, o overrides) problems {
+	var p problems
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		p.add(configPath, 0, "%v", err)
+		return p
+	}
+
+	overridden, err := applyOverrides(data, o)
+	if err != nil {
+		p.add(configPath, jsonErrorLine(data, err), "%v", err)
+		return p
+	}
+
+	var config Config
+	if err := json.Unmarshal(overridden, &config); err != nil {
+		// line numbers only hold for the file as written
+		line := 0
+		if len(o) == 0 {
+			line = jsonErrorLine(data, err)
+		}
+		p.add(configPath, line, "%v", err)
+		return p
+	}
+
+	if definition {
+		resolveTemplateFiles(&config, filepath.Dir(configPath))
+	}
+
+	var timeFormats = make(map[string]bool)
+	setTimeFormats(timeFormats)
+	if !timeFormats[config.TimeFormat] {
+		formats := make([]string, 0, len(timeFormats))
+		for format := range timeFormats {
+			formats = append(formats, format)
+		}
+		sort.Strings(formats)
+		p.add(configPath, 0, "invalid time_format %q, valid formats are %q", config.TimeFormat, formats)
+	}
+	for _, err := range configErrors(&config) {
+		p.add(configPath, 0, "%v", err)
+	}
+
+	if !config.FileWrite && !config.ESSend {
+		p.add(configPath, 0, "neither file_write nor es_send is set, nothing would be generated")
+	}
+	if config.FileWrite {
+		if config.FileName == "" {
+			p.add(configPath, 0, "file_write is set but file_name is empty")
+		}
+		if info, err := os.Stat(config.FilePath); err != nil || !info.IsDir() {
+			p.add(configPath, 0, "file_path %q is not a directory", config.FilePath)
+		}
+	}
+	if config.ESSend {
+		if config.ESKey == "" && config.ESTarget == nil {
+			p.add(configPath, 0, "es_send is set but neither es_key nor es_target is provided")
+		} else if config.ESTarget == nil {
+			if _, err := createTargetsFromKey(&config); err != nil {
+				p.add(configPath, 0, "es_key can not be decrypted: %v", err)
+			}
+		} else if _, err := config.ESTarget.TLS.build(); err != nil {
+			p.add(configPath, 0, "es_target tls: %v", err)
+		}
+	}
+
+	if config.LogsPerMin == 0 {
+		p.add(configPath, 0, "logs_per_min is 0, nothing would be generated")
+	}
+	if config.LogInterval <= 0 {
+		p.add(configPath, 0, "log_interval has to be greater than 0")
+	}
+
+	if len(templatePaths) == 0 && len(config.TemplateFiles) == 0 {
+		p.add(configPath, 0, "no template files, pass them as arguments or set template_files")
+	}
+	for _, path := range config.TemplateFiles {
+		validateTemplateFile(path, &p)
+	}
+	templateFiles := len(templatePaths) + len(config.TemplateFiles)
+
+	if config.LogsPerMin > 0 && config.LogInterval > 0 {
+		if err := checkLogsPerInterval(config.LogsPerMin, config.LogInterval, templateFiles); err != nil {
+			p.add(configPath, 0, "%v", err)
+		}
+	}
+
+	return p
+}
+
+// jsonErrorLine returns the line of a JSON decoding error, or 0 if the error
+// carries no offset.
+func jsonErrorLine(data []byte, err error) int {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return 0
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return strings.Count(string(data[:offset]), "\n") + 1
+}
+
+// validateTemplateFile checks every line of a template file has the form
+// "level = <level>, message = <message>", or continues the message of the
+// template above it, and only uses known placeholders.
+func validateTemplateFile(path string, p *problems) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		p.add(path, 0, "%v", err)
+		return
+	}
+
+	templates := 0
+	continuing := false
+	for i, line := range strings.Split(string(data), "\n") {
+		if text, ok := continuation(line); ok {
+			if !continuing {
+				p.add(path, i+1, "indented line continues a message but there is no template line above it")
+			}
+			checkPlaceholders(text, path, i+1, p)
+			continue
+		}
+		continuing = false
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		comma := strings.Index(line, ",")
+		if comma == -1 {
+			p.warn(path, i+1, "no comma after the level, the line is skipped, expected \"level = <level>, message = <message>\"")
+			continue
+		}
+		templates++
+		continuing = true
+
+		level := strings.SplitN(line[:comma], "=", 2)
+		if len(level) != 2 || !strings.EqualFold(strings.TrimSpace(level[0]), "level") {
+			p.add(path, i+1, "bad level syntax %q, expected \"level = <level>\"", line[:comma])
+		} else if value := strings.TrimSpace(level[1]); !knownLevels[strings.ToLower(value)] {
+			p.add(path, i+1, "unknown level %q", value)
+		}
+
+		message := strings.SplitN(line[comma+1:], "=", 2)
+		if len(message) != 2 || !strings.EqualFold(strings.TrimSpace(message[0]), "message") {
+			p.add(path, i+1, "bad message syntax, expected \"message = <message>\" after the level")
+			continue
+		}
+
+		checkPlaceholders(message[1], path, i+1, p)
+	}
+
+	if templates == 0 {
+		p.add(path, 0, "no log templates")
+	}
+}
+
+// checkPlaceholders reports the unknown placeholders of a message.
+func checkPlaceholders(message, path string, line int, p *problems) {
+	for _, name := range unknownPlaceholders(message) {
+		if kafkaPlaceholders[name] {
+			p.warn(path, line, "%s is only replaced by the kafka generator, it is sent as written", name)
+		} else {
+			p.add(path, line, "unknown placeholder %s, use one of %s", name, strings.Join(placeholders, ", "))
+		}
+	}
+}
+
+// unknownPlaceholders returns the $NAME tokens of a message that do not
+// start with a known placeholder. Placeholders are replaced wherever they
+// occur, so "$INTseconds" is $INT followed by "seconds".
+func unknownPlaceholders(message string) []string {
+	var unknown []string
+	for i := 0; i < len(message); i++ {
+		if message[i] != '$' || i+1 == len(message) || !isIdentByte(message[i+1]) {
+			continue
+		}
+
+		known := false
+		for _, placeholder := range placeholders {
+			if strings.HasPrefix(message[i:], placeholder) {
+				known = true
+				break
+			}
+		}
+
+		end := i + 1
+		for end < len(message) && isIdentByte(message[end]) {
+			end++
+		}
+		if !known && (message[i+1] < '0' || message[i+1] > '9') {
+			unknown = append(unknown, message[i:end])
+		}
+		i = end - 1
+	}
+	return unknown
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+const benchRecords = 1000
+
+// benchTime is how long the bench command runs each measurement, go test
+// -bench runs the same code through BenchmarkBatch.
+const benchTime = time.Second
+
+// buildBatch builds a batch of benchRecords records of a topic, from picking
+// the template to the request body, and returns the size of the body.
+func buildBatch(topicConfig *Config, topicLogs []logLine, r *rand.Rand) int {
+	batch := newRecordBatch(topicConfig)
+	for j := 0; j < benchRecords; j++ {
+		kafkaRecord, line := getRandomLog(topicLogs, topicConfig, r)
+		record, err := json.Marshal(kafkaRecord)
+		if err != nil {
+			log.Fatal(err)
+		}
+		batch.add(record, line.template)
+	}
+	return len(batch.body())
+}
+
+// measurement is the cost of one call of a measured function.
+type measurement struct {
+	n        int
+	nsPerOp  int64
+	bytes    uint64
+	allocs   uint64
+	bodySize int
+}
+
+func (m measurement) String() string {
+	mbPerSec := 0.0
+	if m.nsPerOp > 0 {
+		mbPerSec = float64(m.bodySize) * 1e3 / float64(m.nsPerOp)
+	}
+	return fmt.Sprintf("%8d %12d ns/op %8.2f MB/s %10d B/op %8d allocs/op", m.n, m.nsPerOp, mbPerSec, m.bytes, m.allocs)
+}
+
+// measure calls f until benchTime has passed and returns its cost per call.
+// f returns the number of bytes it produced.
+func measure(f func() int) measurement {
+	f()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	m := measurement{}
+	for time.Since(start) < benchTime {
+		m.bodySize = f()
+		m.n++
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	m.nsPerOp = elapsed.Nanoseconds() / int64(m.n)
+	m.bytes = (after.TotalAlloc - before.TotalAlloc) / uint64(m.n)
+	m.allocs = (after.Mallocs - before.Mallocs) / uint64(m.n)
+	return m
+}
+
+// runBatchBenchmark measures building a batch of benchRecords records for
+// every topic and prints allocs/op.
+func runBatchBenchmark(topicConfigs []*Config, topicLogs [][]logLine) {
+	for i, topicConfig := range topicConfigs {
+		r := rand.New(rand.NewSource(1))
+		m := measure(func() int {
+			return buildBatch(topicConfig, topicLogs[i], r)
+		})
+		fmt.Printf("batch of %d records, topic %s: %s\n", benchRecords, topicConfig.statsName(), m)
+	}
+}
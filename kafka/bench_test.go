@@ -0,0 +1,24 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// BenchmarkBatch measures building a batch of benchRecords records of the
+// first topic of the example config, run with go test -bench Batch -benchmem.
+func BenchmarkBatch(b *testing.B) {
+	gens, err := loadGenerators("config.json", []string{"logTemp1", "logTemp2", "logTemp3"}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	topicConfig, topicLogs := gens[0].configs[0], gens[0].logs[0]
+
+	b.ReportAllocs()
+	r := rand.New(rand.NewSource(1))
+	var size int
+	for n := 0; n < b.N; n++ {
+		size = buildBatch(topicConfig, topicLogs, r)
+	}
+	b.SetBytes(int64(size))
+}
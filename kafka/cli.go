@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// envPrefix is the prefix of the environment variables flags fall back to.
+const envPrefix = "LOGGEN_"
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+func commands() []command {
+	return []command{
+		{"run", "Generate logs and send them to the Kafka topics of the config", runCommand},
+		{"validate", "Check the config and template files and report every problem", validateCommand},
+		{"preview", "Print the first records of every topic in the wire format instead of sending", previewCommand},
+		{"bench", "Benchmark record generation and batch encoding", benchCommand},
+		{"coordinate", "Split a run across worker processes and report on the whole run", coordinateCommand},
+		{"worker", "Join a coordinator and run its share of the run", workerCommand},
+	}
+}
+
+// runCLI runs the command named by the first argument. Without a command the
+// arguments are passed to run, so "loggen-kafka config.json logTemp1" still works.
+func runCLI(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return 0
+	}
+
+	for _, c := range commands() {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	return runCommand(args)
+}
+
+func printUsage() {
+	fmt.Println("Usage: loggen-kafka <command> [flags] config.json|definitions/ [logTemp ...]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, c := range commands() {
+		fmt.Printf("  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Println()
+	fmt.Println("Run \"loggen-kafka <command> -help\" for the flags of a command. Every flag falls back to")
+	fmt.Printf("the %s<FLAG> environment variable, e.g. %sLOGS_PER_MIN, and the config and\n", envPrefix, envPrefix)
+	fmt.Printf("template files to %sCONFIG and %sTEMPLATES (comma separated).\n", envPrefix, envPrefix)
+}
+
+// overrides collects config overrides as "path=value", path being the
+// dotted json keys of a config field.
+type overrides []string
+
+func (o *overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("expected path=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// fieldFlag overrides a top level config field.
+type fieldFlag struct {
+	name   string
+	isBool bool
+	o      *overrides
+}
+
+func (f fieldFlag) String() string {
+	return ""
+}
+
+func (f fieldFlag) Set(value string) error {
+	return f.o.Set(f.name + "=" + value)
+}
+
+func (f fieldFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// newFlagSet returns the flags of a command. withConfig adds -set and a flag
+// named after the json key of every scalar top level Config field.
+func newFlagSet(name string, usageArgs string, summary string, withConfig bool) (*flag.FlagSet, *overrides) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	o := &overrides{}
+
+	if withConfig {
+		fs.Var(o, "set", "override any config field as `path=value`, the path is dotted json keys e.g. tls.ca_file=/etc/ca.pem or tags._tag_appName=app (repeatable)")
+
+		t := reflect.TypeOf(Config{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+			if jsonName == "" || jsonName == "-" || field.PkgPath != "" {
+				continue
+			}
+			switch field.Type.Kind() {
+			case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Uint64, reflect.Float64:
+				fs.Var(fieldFlag{jsonName, field.Type.Kind() == reflect.Bool, o}, jsonName, "override config field "+jsonName)
+			}
+		}
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: loggen-kafka %s [flags] %s\n\n%s.\n\nFlags:\n", name, usageArgs, summary)
+		fs.PrintDefaults()
+	}
+	return fs, o
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseCommand parses the flags of a command, fills flags that were not
+// given from the environment and returns the positional arguments. Config
+// overrides from the environment are applied before the ones given as
+// flags. code is -1 when the command should go on.
+func parseCommand(fs *flag.FlagSet, o *overrides, args []string, minArgs int) (positional []string, code int) {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil, 0
+	} else if err != nil {
+		return nil, 2
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	fromFlags := append(overrides(nil), *o...)
+	*o = (*o)[:0]
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || envErr != nil {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+			}
+		}
+	})
+	*o = append(*o, fromFlags...)
+	if envErr != nil {
+		fmt.Println(envErr)
+		return nil, 2
+	}
+
+	positional = fs.Args()
+	if len(positional) == 0 && os.Getenv(envPrefix+"CONFIG") != "" {
+		positional = []string{os.Getenv(envPrefix + "CONFIG")}
+		positional = append(positional, strings.FieldsFunc(os.Getenv(envPrefix+"TEMPLATES"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+
+	if len(positional) < minArgs {
+		fmt.Println("Insufficient arguments")
+		fs.Usage()
+		return nil, 2
+	}
+	return positional, -1
+}
+
+// applyOverrides returns the config JSON with the overrides applied. Values
+// of string fields are taken as is, other values are parsed as JSON.
+func applyOverrides(data []byte, o overrides) ([]byte, error) {
+	if len(o) == 0 {
+		return data, nil
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+
+	for _, override := range o {
+		parts := strings.SplitN(override, "=", 2)
+		keys := strings.Split(parts[0], ".")
+
+		fieldType := configFieldType(reflect.TypeOf(Config{}), keys)
+		if fieldType == nil {
+			return nil, fmt.Errorf("unknown config field %s", parts[0])
+		}
+
+		var value interface{} = parts[1]
+		if fieldType.Kind() != reflect.String {
+			if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+				value = parts[1]
+			}
+		}
+
+		m := doc
+		for _, key := range keys[:len(keys)-1] {
+			next, ok := m[key].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				m[key] = next
+			}
+			m = next
+		}
+		m[keys[len(keys)-1]] = value
+	}
+
+	return json.Marshal(doc)
+}
+
+// configFieldType follows json keys through the config types and returns the
+// type of the field, or nil if there is no such field.
+func configFieldType(t reflect.Type, keys []string) reflect.Type {
+	for _, key := range keys {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			var found reflect.Type
+			for i := 0; i < t.NumField(); i++ {
+				if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == key {
+					found = t.Field(i).Type
+					break
+				}
+			}
+			if found == nil {
+				return nil
+			}
+			t = found
+		default:
+			return nil
+		}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func readConfigFile(path string, o overrides) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return applyOverrides(data, o)
+}
+
+func runCommand(args []string) int {
+	fs, o := newFlagSet("run", "config.json|definitions/ [logTemp ...]", "Generate logs and send them to the Kafka topics of the config", true)
+	var opts runOptions
+	var seed seedFlag
+	fs.Var(&seed, "seed", "seed of the random generators, the same seed replays the same records per topic, drawn from the clock when not set")
+	dryRunMode := fs.Bool("dry-run", false, "same as the preview command")
+	records := fs.Int("records", 10, "number of records per topic printed by -dry-run")
+	fs.DurationVar(&opts.statsInterval, "stats-interval", 10*time.Second, "how often the status table of every sink is printed, 0 turns it off")
+	fs.DurationVar(&opts.duration, "duration", 0, "stop after this long and print the run summary, 0 runs until interrupted")
+	fs.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this `address` under /metrics, e.g. :9100")
+	fs.StringVar(&opts.report, "report", "", "write a JSON report of the run to this `file` at exit")
+	fs.StringVar(&opts.controlAddr, "control-addr", "", "serve the control API on this `address`, e.g. 127.0.0.1:9101")
+	fs.BoolVar(&opts.watch, "watch", false, "reload the config and template files when they change, SIGHUP always reloads them")
+	fs.BoolVar(&quiet, "quiet", false, "only print errors, for CI logs")
+
+	args, code := parseCommand(fs, o, args, 1)
+	if code >= 0 {
+		return code
+	}
+
+	gens, err := loadGenerators(args[0], args[1:], *o)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	opts.seed = seed.value()
+
+	if *dryRunMode {
+		return preview(gens, opts.seed, *records)
+	}
+
+	opts.overrides = *o
+	if err := runGenerator(gens, opts); err == errThresholdsViolated {
+		return exitThresholds
+	} else if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func validateCommand(args []string) int {
+	fs, o := newFlagSet("validate", "config.json|definitions/ [logTemp ...]", "Check the config and template files and report every problem with its file and line", true)
+
+	args, code := parseCommand(fs, o, args, 1)
+	if code >= 0 {
+		return code
+	}
+
+	return runValidate(args[0], args[1:], *o)
+}
+
+func previewCommand(args []string) int {
+	fs, o := newFlagSet("preview", "config.json|definitions/ [logTemp ...]", "Print the request body of the first records of every topic to stdout instead of sending", true)
+	var seed seedFlag
+	fs.Var(&seed, "seed", "seed of the random generators, use the seed of a run to preview its first records, drawn from the clock when not set")
+	records := fs.Int("records", 10, "number of records per topic")
+
+	args, code := parseCommand(fs, o, args, 1)
+	if code >= 0 {
+		return code
+	}
+
+	gens, err := loadGenerators(args[0], args[1:], *o)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	return preview(gens, seed.value(), *records)
+}
+
+func preview(gens []*generator, seed int64, records int) int {
+	for _, g := range gens {
+		dryRun(g.configs, g.logs, seed, records)
+	}
+	return 0
+}
+
+func benchCommand(args []string) int {
+	fs, o := newFlagSet("bench", "config.json|definitions/ [logTemp ...]", "Benchmark record generation and batch encoding of every topic, printing ns/op, B/op and allocs/op", true)
+
+	args, code := parseCommand(fs, o, args, 1)
+	if code >= 0 {
+		return code
+	}
+
+	gens, err := loadGenerators(args[0], args[1:], *o)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	runBatchBenchmark(allTopicConfigs(gens), allTopicLogs(gens))
+	return 0
+}
+
+func coordinateCommand(args []string) int {
+	fs, o := newFlagSet("coordinate", "config.json|definitions/ [logTemp ...]", "Split the logs_per_min of every topic across worker processes started with the worker command, and print and report the statistics of the whole run", true)
+	var opts coordinatorOptions
+	fs.StringVar(&opts.listen, "listen", "127.0.0.1:9102", "`address` workers join on")
+	fs.IntVar(&opts.workers, "workers", 2, "number of workers to wait for, the run starts when all of them joined")
+	var seed seedFlag
+	fs.Var(&seed, "seed", "seed of the run, worker i runs with seed+i, drawn from the clock when not set")
+	fs.DurationVar(&opts.statsInterval, "stats-interval", 10*time.Second, "how often the status table of the whole run is printed, 0 turns it off")
+	fs.DurationVar(&opts.duration, "duration", 0, "stop the workers after this long, 0 runs until interrupted")
+	fs.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve Prometheus metrics of the whole run on this `address` under /metrics")
+	fs.StringVar(&opts.report, "report", "", "write a JSON report of the whole run to this `file` at exit")
+	fs.BoolVar(&quiet, "quiet", false, "only print errors, for CI logs")
+
+	args, code := parseCommand(fs, o, args, 1)
+	if code >= 0 {
+		return code
+	}
+	if opts.workers < 1 {
+		fmt.Println("-workers has to be at least 1")
+		return 2
+	}
+
+	gens, err := loadGenerators(args[0], args[1:], *o)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	opts.seed = seed.value()
+	if err := runCoordinator(gens, args[1:], opts); err == errThresholdsViolated {
+		return exitThresholds
+	} else if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func workerCommand(args []string) int {
+	fs, _ := newFlagSet("worker", "", "Join the coordinator of a distributed run, run the share of the run it hands out and post the statistics back", false)
+	var opts runOptions
+	addr := fs.String("coordinator", "", "`address` of the coordinator, e.g. 127.0.0.1:9102")
+	fs.DurationVar(&opts.statsInterval, "stats-interval", 10*time.Second, "how often the status table of the worker is printed, 0 turns it off")
+	fs.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve Prometheus metrics of the worker on this `address` under /metrics")
+	fs.BoolVar(&quiet, "quiet", false, "only print errors, for CI logs")
+
+	if _, code := parseCommand(fs, &overrides{}, args, 0); code >= 0 {
+		return code
+	}
+	if *addr == "" {
+		fmt.Println("-coordinator is required")
+		fs.Usage()
+		return 2
+	}
+
+	if err := runWorker(*addr, opts); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
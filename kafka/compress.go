@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"sync/atomic"
+)
+
+// Request body bytes before and after compression of the requests a sink
+// answered with 200, for the whole run.
+var uncompressedBytes, sentBytes uint64
+
+// countSent counts the body of a request the sink answered with 200.
+func countSent(uncompressed int, wire int) {
+	atomic.AddUint64(&uncompressedBytes, uint64(uncompressed))
+	atomic.AddUint64(&sentBytes, uint64(wire))
+}
+
+func checkCompression(compression string) error {
+	switch compression {
+	case "", "none", "gzip":
+		return nil
+	case "zstd":
+		return errors.New("zstd compression is not supported by this build, use gzip")
+	}
+	return errors.New("compression has to be either none or gzip")
+}
+
+// compressBody encodes a request body with the configured compression and
+// returns it with the Content-Encoding to send, which is empty when the body
+// is sent as is.
+func compressBody(compression string, data []byte) ([]byte, string, error) {
+	if compression != "gzip" {
+		return data, "", nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) / 4)
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "gzip", nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generator is a config being run with the config and log templates of its
+// topics. A run of a definitions directory has one generator per definition.
+type generator struct {
+	// name of the definition, empty for a single config
+	name          string
+	path          string
+	templatePaths []string
+	config        *Config
+	configs       []*Config
+	logs          [][]logLine
+}
+
+// statsName returns the name of the topic in stats, metrics and reports,
+// prefixed by the definition in a definitions directory run.
+func (config *Config) statsName() string {
+	if config.definition == "" {
+		return config.KafkaTopics[0].Name
+	}
+	return config.definition + "/" + config.KafkaTopics[0].Name
+}
+
+// clients are shared by every topic with the same tls settings, so topics of
+// all definitions sending to the same proxy share its connection pool.
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[string]*http.Client)
+)
+
+func clientFor(settings TLSConfig) (*http.Client, error) {
+	key, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c := clients[string(key)]; c != nil {
+		return c, nil
+	}
+
+	tlsConfig, err := settings.build()
+	if err != nil {
+		return nil, err
+	}
+	// keep the proxy, timeouts and pool sizes of the default transport
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c := &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	clients[string(key)] = c
+	return c, nil
+}
+
+// isDefinitionsDir tells whether path is a directory of definitions rather
+// than a config file.
+func isDefinitionsDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// definitionFiles returns the *.json files of dir in order.
+func definitionFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no *.json generator definitions in %s", dir)
+	}
+	return paths, nil
+}
+
+// definitionName returns the name of the definition in path, the file name
+// without .json.
+func definitionName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".json")
+}
+
+// resolveTemplateFiles makes the relative template_files of config relative
+// to dir, the directory of its definition.
+func resolveTemplateFiles(config *Config, dir string) {
+	resolve := func(paths []string) []string {
+		resolved := make([]string, len(paths))
+		for i, path := range paths {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			resolved[i] = path
+		}
+		return resolved
+	}
+	config.TemplateFiles = resolve(config.TemplateFiles)
+	for i := range config.KafkaTopics {
+		config.KafkaTopics[i].TemplateFiles = resolve(config.KafkaTopics[i].TemplateFiles)
+	}
+}
+
+// loadGenerator loads the config at path and the template files of its
+// topics and checks them. name is the definition name, empty for a single
+// config.
+func loadGenerator(name, path string, templatePaths []string, o overrides) (*generator, error) {
+	config, err := loadConfig(path, o)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		resolveTemplateFiles(config, filepath.Dir(path))
+		config.definition = name
+	}
+	if config.client, err = clientFor(config.TLS); err != nil {
+		return nil, err
+	}
+
+	g := &generator{name: name, path: path, templatePaths: templatePaths, config: config}
+	// loadTemplateFiles exits on files it can not open
+	for _, file := range g.watchedFiles()[1:] {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	if g.configs, g.logs, err = setupTopics(config, templatePaths); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// loadGenerators loads the config at path, or every definition if path is a
+// definitions directory.
+func loadGenerators(path string, templatePaths []string, o overrides) ([]*generator, error) {
+	if isDefinitionsDir(path) {
+		return loadDefinitions(path, templatePaths, o)
+	}
+	g, err := loadGenerator("", path, templatePaths, o)
+	if err != nil {
+		return nil, err
+	}
+	return []*generator{g}, nil
+}
+
+// loadDefinitions loads every definition in dir. templatePaths are used by
+// the topics of every definition without template_files of their own.
+func loadDefinitions(dir string, templatePaths []string, o overrides) ([]*generator, error) {
+	paths, err := definitionFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]*generator, 0, len(paths))
+	for _, path := range paths {
+		g, err := loadGenerator(definitionName(path), path, templatePaths, o)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		gens = append(gens, g)
+	}
+	return gens, nil
+}
+
+// watchedFiles returns the config file and every template file of the
+// generator.
+func (g *generator) watchedFiles() []string {
+	files := append([]string{g.path}, g.templatePaths...)
+	files = append(files, g.config.TemplateFiles...)
+	for _, topic := range g.config.KafkaTopics {
+		files = append(files, topic.TemplateFiles...)
+	}
+	return files
+}
+
+// allTopicConfigs returns the config of every topic of gens.
+func allTopicConfigs(gens []*generator) []*Config {
+	var configs []*Config
+	for _, g := range gens {
+		configs = append(configs, g.configs...)
+	}
+	return configs
+}
+
+// allTopicLogs returns the log templates of every topic of gens, in the
+// order of allTopicConfigs.
+func allTopicLogs(gens []*generator) [][]logLine {
+	var logs [][]logLine
+	for _, g := range gens {
+		logs = append(logs, g.logs...)
+	}
+	return logs
+}
+
+// digest returns the config digest of the run: the digest of the config
+// for a single config, of every definition by name for a directory.
+func digest(gens []*generator) string {
+	if len(gens) == 1 && gens[0].name == "" {
+		return configDigest(gens[0].config)
+	}
+	h := sha256.New()
+	for _, g := range gens {
+		data, err := json.Marshal(g.config)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(h, "%s\n%s\n", g.name, data)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
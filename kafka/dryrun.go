@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+)
+
+// dryRun prints the request body every topic of a config would receive for
+// its first records to stdout instead of sending it. Topic headers go to
+// stderr, so stdout only holds the records.
+func dryRun(topicConfigs []*Config, topicLogs [][]logLine, seed int64, records int) {
+	for i, topicConfig := range topicConfigs {
+		topicName := topicConfig.KafkaTopics[0].Name
+		r := rand.New(rand.NewSource(workerSeed(definitionSeed(seed, topicConfig.definition), i, 0)))
+
+		batch := newRecordBatch(topicConfig)
+		for j := 0; j < records; j++ {
+			kafkaRecord, line := getRandomLog(topicLogs[i], topicConfig, r)
+			record, err := json.Marshal(kafkaRecord)
+			if err != nil {
+				log.Fatal(err)
+			}
+			batch.add(record, line.template)
+		}
+
+		fmt.Fprintf(os.Stderr, "# topic %s: POST %s (seed %d)\n", topicConfig.statsName(), kafkaURL(topicConfig, topicName), seed)
+		os.Stdout.Write(batch.body())
+		fmt.Println()
+	}
+}
@@ -3,33 +3,36 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var client http.Client = http.Client{
-	Timeout:   30 * time.Second,
-	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
-}
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+// sends tracks the requests in flight, so a run can wait for them at exit.
+var sends sync.WaitGroup
 
-var count = 0
+var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 // Config ...
 type Config struct {
 	IP                string            `json:"ip"`
-	KafkaTopics       []string          `json:"kafka_topics"`
+	KafkaTopics       []TopicConfig     `json:"kafka_topics"`
 	AuthToken         string            `json:"auth_token"`
 	Tags              map[string]string `json:"tags"`
 	ExtraTags         map[string]string `json:"extraJson"`
@@ -39,17 +42,147 @@ type Config struct {
 	FlushInterval     uint64            `json:"flush_interval"`
 	SaveLogsToFile    string            `json:"save_logs_onto_file"`
 	SendLargeJsonLogs string            `json:"send_json_logs_kafka"`
+	RecordKey         string            `json:"record_key"`
+	Partition         *int              `json:"partition"`
+	Headers           map[string]string `json:"headers"`
+	RestAPIVersion    string            `json:"rest_api_version"`
+	TLS               TLSConfig         `json:"tls"`
+	Compression       string            `json:"compression"`
+	Thresholds        *Thresholds       `json:"thresholds"`
+	TemplateFiles     []string          `json:"template_files"`
+
+	// definition is the name of the definition in a definitions directory
+	// run, empty for a single config
+	definition string
+	// client sends the requests of the topic, shared by topics with the same
+	// tls settings
+	client *http.Client
+	// logIndex counts the records of a topic for the log_index field
+	logIndex *uint64
+	// stats of the topic, set by runGenerator
+	stats *sinkStats
+	// fileStats is the sink of save_logs_onto_file, set by runGenerator
+	fileStats *sinkStats
+}
+
+// TopicConfig holds the settings of a single Kafka topic. Zero values fall
+// back to the top level Config, tags are merged over the top level tags.
+type TopicConfig struct {
+	Name          string            `json:"name"`
+	LogsPerMin    uint64            `json:"logs_per_min"`
+	MaxBulkCount  uint64            `json:"max_bulk_count"`
+	MaxBulkSize   uint64            `json:"max_bulk_size"`
+	Tags          map[string]string `json:"tags"`
+	TemplateFiles []string          `json:"template_files"`
+	RecordKey     string            `json:"record_key"`
+	Partition     *int              `json:"partition"`
+	Headers       map[string]string `json:"headers"`
+}
+
+// UnmarshalJSON accepts either a plain topic name or a topic object.
+func (t *TopicConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = TopicConfig{Name: name}
+		return nil
+	}
+
+	type topicConfig TopicConfig
+	var topic topicConfig
+	if err := json.Unmarshal(data, &topic); err != nil {
+		return err
+	}
+	*t = TopicConfig(topic)
+	return nil
+}
+
+// forTopic returns a copy of the config with the topic overrides applied.
+func (config *Config) forTopic(topic TopicConfig) *Config {
+	topicConfig := *config
+	topicConfig.KafkaTopics = []TopicConfig{topic}
+	topicConfig.logIndex = new(uint64)
+
+	if topic.LogsPerMin > 0 {
+		topicConfig.LogsPerMin = topic.LogsPerMin
+	}
+	if topic.MaxBulkCount > 0 {
+		topicConfig.MaxBulkCount = topic.MaxBulkCount
+	}
+	if topic.MaxBulkSize > 0 {
+		topicConfig.MaxBulkSize = topic.MaxBulkSize
+	}
+	if len(topic.Tags) > 0 {
+		topicConfig.Tags = make(map[string]string, len(config.Tags)+len(topic.Tags))
+		for key, value := range config.Tags {
+			topicConfig.Tags[key] = value
+		}
+		for key, value := range topic.Tags {
+			topicConfig.Tags[key] = value
+		}
+	}
+	if topic.RecordKey != "" {
+		topicConfig.RecordKey = topic.RecordKey
+	}
+	if topic.Partition != nil {
+		topicConfig.Partition = topic.Partition
+	}
+	if len(topic.Headers) > 0 {
+		topicConfig.Headers = topic.Headers
+	}
+
+	return &topicConfig
+}
+
+// sortedKeys returns the keys of m in order, so random values are drawn in
+// the same order on every run with the same seed.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// logLine is a parsed template line, "level=<level>, message=<message>".
+type logLine struct {
+	// template is the name of the file the line came from
+	template string
+	level    string
+	message  string
 }
 
-func getRandomLog(allLogs []string, config *Config) map[string]interface{} {
+// parseLogLine parses a template line, ok is false if the line is not in the
+// template format.
+func parseLogLine(template string, line string) (logLine, bool) {
+	logWithLevel := strings.SplitN(line, ",", 2)
+	if len(logWithLevel) < 2 {
+		return logLine{}, false
+	}
+	level := strings.SplitN(logWithLevel[0], "=", 2)
+	message := strings.SplitN(logWithLevel[1], "=", 2)
+	if len(level) < 2 || len(message) < 2 {
+		return logLine{}, false
+	}
 
-	rand.Seed(time.Now().UnixNano())
-	indexToUse := rand.Intn(len(allLogs))
+	return logLine{
+		template: template,
+		level:    strings.ToLower(strings.TrimSpace(level[1])),
+		message:  strings.TrimSpace(message[1]),
+	}, true
+}
 
-	logWithLevel := strings.SplitN(allLogs[indexToUse], ",", 2)
+// getRandomLog builds a record from a random template line and returns it
+// with the line.
+func getRandomLog(allLogs []logLine, config *Config, r *rand.Rand) (map[string]interface{}, logLine) {
+
+	line := allLogs[r.Intn(len(allLogs))]
+	if control.bursting(r) {
+		line = errorLine(allLogs, line, r)
+	}
 
 	record := make(map[string]interface{})
-	record["level"] = strings.ToLower(strings.TrimSpace(strings.SplitN(logWithLevel[0], "=", 2)[1]))
+	record["level"] = line.level
 	record["time"] = time.Now().Unix() * 1000
 
 	for key, value := range config.Tags {
@@ -57,15 +190,15 @@ func getRandomLog(allLogs []string, config *Config) map[string]interface{} {
 	}
 
 	if config.SendLargeJsonLogs == "true" {
-		for key, value := range config.ExtraTags {
+		for _, key := range sortedKeys(config.ExtraTags) {
+			value := config.ExtraTags[key]
 			if key == "log_index" {
-				count = count + 1
-				record[key] = strconv.Itoa(count)
+				record[key] = strconv.FormatUint(atomic.AddUint64(config.logIndex, 1), 10)
 			} else {
 				record[key] = strings.ReplaceAll(value, "", func(n int) string {
 					b := make([]rune, n)
 					for i := range b {
-						b[i] = letters[rand.Intn(len(letters))]
+						b[i] = letters[r.Intn(len(letters))]
 					}
 					return string(b)
 				}(7))
@@ -73,80 +206,321 @@ func getRandomLog(allLogs []string, config *Config) map[string]interface{} {
 		}
 	}
 
-	message := strings.TrimSpace(strings.SplitN(logWithLevel[1], "=", 2)[1])
-	message = strings.ReplaceAll(message, "$IP", fmt.Sprintf("%d.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Intn(256)))
-	message = strings.ReplaceAll(message, "$INT", fmt.Sprintf("%d", rand.Intn(65535)+1))
-	message = strings.ReplaceAll(message, "$STRING", func(n int) string {
+	record["message"] = expandPlaceholders(line.message, r)
+
+	kafkaRecord := make(map[string]interface{})
+
+	if config.RestAPIVersion == "v3" {
+		if config.RecordKey != "" {
+			kafkaRecord["key"] = map[string]interface{}{"type": "STRING", "data": expandRecordExpression(config.RecordKey, record, r)}
+		}
+		if config.Partition != nil {
+			kafkaRecord["partition_id"] = *config.Partition
+		}
+		if len(config.Headers) > 0 {
+			kafkaRecord["headers"] = buildRecordHeaders(config.Headers, record, r)
+		}
+		kafkaRecord["value"] = map[string]interface{}{"type": "JSON", "data": record}
+		return kafkaRecord, line
+	}
+
+	if config.RecordKey != "" {
+		kafkaRecord["key"] = expandRecordExpression(config.RecordKey, record, r)
+	}
+	if config.Partition != nil {
+		kafkaRecord["partition"] = *config.Partition
+	}
+	kafkaRecord["value"] = record
+
+	return kafkaRecord, line
+}
+
+// buildRecordHeaders renders the configured headers for one record in the
+// REST v3 form, where header values are base64 encoded bytes.
+func buildRecordHeaders(headers map[string]string, record map[string]interface{}, r *rand.Rand) []map[string]interface{} {
+	recordHeaders := make([]map[string]interface{}, 0, len(headers))
+	for _, name := range sortedKeys(headers) {
+		value := expandRecordExpression(headers[name], record, r)
+		recordHeaders = append(recordHeaders, map[string]interface{}{
+			"name":  name,
+			"value": base64.StdEncoding.EncodeToString([]byte(value)),
+		})
+	}
+	return recordHeaders
+}
+
+// expandPlaceholders replaces $IP, $INT and $STRING with random values and
+// the stack trace placeholders with traces.
+func expandPlaceholders(s string, r *rand.Rand) string {
+	s = strings.ReplaceAll(s, "$IP", fmt.Sprintf("%d.%d.%d.%d", r.Intn(256), r.Intn(256), r.Intn(256), r.Intn(256)))
+	s = strings.ReplaceAll(s, "$INT", fmt.Sprintf("%d", r.Intn(65535)+1))
+	s = strings.ReplaceAll(s, "$STRING", func(n int) string {
 		b := make([]rune, n)
 		for i := range b {
-			b[i] = letters[rand.Intn(len(letters))]
+			b[i] = letters[r.Intn(len(letters))]
 		}
 		return string(b)
 	}(10))
+	return expandStackTraces(s, r)
+}
 
-	record["message"] = message
+// expandRecordExpression evaluates a template expression against a generated
+// record. ${field} is replaced with the value of that record field (tags,
+// extraJson keys, level, message), then the usual random placeholders apply.
+// Values are not expanded again, so a value holding "${field}" is kept as is.
+func expandRecordExpression(expr string, record map[string]interface{}, r *rand.Rand) string {
+	for from := 0; ; {
+		start := strings.Index(expr[from:], "${")
+		if start == -1 {
+			break
+		}
+		start += from
+		end := strings.Index(expr[start:], "}")
+		if end == -1 {
+			break
+		}
+		end += start
 
-	kafkaRecord := make(map[string]interface{})
-	kafkaRecord["value"] = record
+		value := ""
+		if v, ok := record[expr[start+2:end]]; ok {
+			value = fmt.Sprint(v)
+		}
+		expr = expr[:start] + value + expr[end+1:]
+		from = start + len(value)
+	}
+	return expandPlaceholders(expr, r)
+}
 
-	return kafkaRecord
+// recordBatch holds records encoded once, as they are generated, in the
+// request body format of the REST API: {"records":[...]} for v2 and one JSON
+// object per line for v3. The same bytes are used for the size check, the
+// request body and the file copy.
+type recordBatch struct {
+	buf     []byte
+	records int
+	v3      bool
+	// templates holds the template file of every record, in order
+	templates []string
+	// lines holds the events of the records as save_logs_onto_file writes them
+	lines []byte
 }
 
-func sendToFile(logsToSave []map[string]interface{}, config *Config) {
-	if config.SaveLogsToFile == "true" {
-		kafkaRecords := make(map[string]interface{})
-		kafkaRecords["records"] = logsToSave
+func newRecordBatch(config *Config) *recordBatch {
+	batch := &recordBatch{v3: config.RestAPIVersion == "v3"}
+	if !batch.v3 {
+		batch.buf = append(batch.buf, `{"records":[`...)
+	}
+	return batch
+}
 
-		kafkaData, err := json.Marshal(kafkaRecords)
-		if err != nil {
-			log.Print(err)
-			return
+func (b *recordBatch) add(record []byte, template string) {
+	b.templates = append(b.templates, template)
+	if b.v3 {
+		b.buf = append(b.buf, record...)
+		b.buf = append(b.buf, '\n')
+	} else {
+		if b.records > 0 {
+			b.buf = append(b.buf, ',')
 		}
+		b.buf = append(b.buf, record...)
+	}
+	b.records++
+}
 
-		file, err := os.OpenFile("jsonLogs.json", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal(err)
-			return
+// size returns the size of the request body once the batch is closed.
+func (b *recordBatch) size() int {
+	if b.v3 {
+		return len(b.buf)
+	}
+	return len(b.buf) + len("]}")
+}
+
+// body closes the batch and returns the request body. No records can be
+// added afterwards.
+func (b *recordBatch) body() []byte {
+	if b.v3 {
+		return b.buf
+	}
+	return append(b.buf, "]}"...)
+}
+
+// logFileLine returns the event of a record the way save_logs_onto_file
+// writes it: time, level and message, with the new lines of a multi-line
+// message kept like file_write of the ES generator does.
+func logFileLine(config *Config, kafkaRecord map[string]interface{}) string {
+	record := kafkaRecord["value"].(map[string]interface{})
+	if config.RestAPIVersion == "v3" {
+		record = record["data"].(map[string]interface{})
+	}
+	t := time.Unix(0, record["time"].(int64)*int64(time.Millisecond)).UTC()
+	return fmt.Sprintf("%s %v %v\n", t.Format(time.RFC3339), record["level"], record["message"])
+}
+
+// sendToFile appends the event lines of a batch to jsonLogs.json.
+func sendToFile(lines []byte, templates []string, config *Config) {
+	if config.SaveLogsToFile != "true" {
+		return
+	}
+	noOfLogs := len(templates)
+	if !config.fileStats.enabled() {
+		// records are dropped while the sink is disabled through the control API
+		config.fileStats.drop(noOfLogs, len(lines))
+		config.fileStats.fail("disabled", noOfLogs)
+		countTemplates(config.fileStats, templates, allRecords)
+		return
+	}
+	start := config.fileStats.begin()
+	file, err := os.OpenFile("jsonLogs.json", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if _, err := file.Write(lines); err != nil {
+		log.Fatal(err)
+		return
+	}
+	if err := file.Close(); err != nil {
+		log.Fatal(err)
+		return
+	}
+	config.fileStats.done(start, noOfLogs, 0, len(lines))
+	countTemplates(config.fileStats, templates, noRecords)
+}
+
+// kafkaURL returns the endpoint records of the topic are posted to.
+func kafkaURL(config *Config, topicName string) string {
+	if config.RestAPIVersion == "v3" {
+		return fmt.Sprintf("%s/%s/records", strings.TrimSuffix(config.IP, "/"), topicName)
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(config.IP, "/"), topicName)
+}
+
+// sendToKafkaV3 produces records through the REST v3 API in streaming mode:
+// records are sent as concatenated JSON objects and the proxy answers with
+// one result object per record.
+func sendToKafkaV3(kafkaData []byte, templates []string, config *Config, topicName string) {
+	noOfLogs := len(templates)
+	kafkaURL := kafkaURL(config, topicName)
+
+	body, contentEncoding, err := compressBody(config.Compression, kafkaData)
+	if err != nil {
+		log.Print(err)
+		config.stats.drop(noOfLogs, len(kafkaData))
+		config.stats.fail("compress", noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
+		return
+	}
+
+	req, err := http.NewRequest("POST", kafkaURL, bytes.NewReader(body))
+	if err != nil {
+		fmt.Println(err)
+		config.stats.drop(noOfLogs, len(kafkaData))
+		config.stats.fail("request", noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", config.AuthToken)
+
+	start := config.stats.begin()
+	res, err := config.client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		config.stats.done(start, noOfLogs, noOfLogs, len(kafkaData))
+		config.stats.fail("transport", noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
+		return
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		fmt.Printf("Failed to send Kafka records due to code:%s\n", res.Status)
+		config.stats.done(start, noOfLogs, noOfLogs, len(kafkaData))
+		config.stats.fail(fmt.Sprintf("http %d", res.StatusCode), noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
+		return
+	}
+
+	failed := 0
+	rejected := make([]bool, noOfLogs)
+	decoder := json.NewDecoder(res.Body)
+	for i := 0; ; i++ {
+		var result struct {
+			ErrorCode int    `json:"error_code"`
+			Message   string `json:"message"`
 		}
-		if _, err := file.Write([]byte(kafkaData)); err != nil {
-			log.Fatal(err)
+		if err := decoder.Decode(&result); err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Println(err)
+			config.stats.done(start, noOfLogs, noOfLogs, len(kafkaData))
+			config.stats.fail("response", noOfLogs)
+			countTemplates(config.stats, templates, allRecords)
 			return
 		}
-		if err := file.Close(); err != nil {
-			log.Fatal(err)
-			return
+		if result.ErrorCode != 200 {
+			failed++
+			config.stats.fail(fmt.Sprintf("record %d", result.ErrorCode), 1)
+			if i < noOfLogs {
+				rejected[i] = true
+			}
 		}
 	}
+	countSent(len(kafkaData), len(body))
+	config.stats.done(start, noOfLogs, failed, len(kafkaData))
+	countTemplates(config.stats, templates, func(i int) bool { return rejected[i] })
+	if failed > 0 {
+		fmt.Printf("Failed to send %d of %d Kafka records\n", failed, noOfLogs)
+	}
 }
 
-func sendToKafka(logsToSend []map[string]interface{}, config *Config, topicName string) {
+func sendToKafka(kafkaData []byte, templates []string, config *Config, topicName string) {
+	noOfLogs := len(templates)
+	if config.RestAPIVersion == "v3" {
+		sendToKafkaV3(kafkaData, templates, config, topicName)
+		return
+	}
 
-	kafkaURL := fmt.Sprintf("%s/%s", strings.TrimSuffix(config.IP, "/"), topicName)
-	kafkaRecords := make(map[string]interface{})
-	kafkaRecords["records"] = logsToSend
+	kafkaURL := kafkaURL(config, topicName)
 
-	kafkaData, err := json.Marshal(kafkaRecords)
+	body, contentEncoding, err := compressBody(config.Compression, kafkaData)
 	if err != nil {
 		log.Print(err)
+		config.stats.drop(noOfLogs, len(kafkaData))
+		config.stats.fail("compress", noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
 		return
 	}
 
-	fmt.Printf("Sending %d logs / %d bytes to Kafka\n", len(logsToSend), len(kafkaData))
-
-	req, err := http.NewRequest("POST", kafkaURL, bytes.NewBuffer(kafkaData))
+	req, err := http.NewRequest("POST", kafkaURL, bytes.NewReader(body))
 	if err != nil {
 		fmt.Println(err)
+		config.stats.drop(noOfLogs, len(kafkaData))
+		config.stats.fail("request", noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
 		return
 	}
 
 	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
-	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
 	req.Header.Set("Accept", "application/vnd.kafka.v2+json,application/json")
 	req.Header.Set("Authorization", config.AuthToken)
 
-	res, err := client.Do(req)
+	start := config.stats.begin()
+	res, err := config.client.Do(req)
 	if err != nil {
 		fmt.Println(err)
+		config.stats.done(start, noOfLogs, noOfLogs, len(kafkaData))
+		config.stats.fail("transport", noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
 		return
 	}
 
@@ -154,65 +528,83 @@ func sendToKafka(logsToSend []map[string]interface{}, config *Config, topicName
 
 	if res.StatusCode != 200 {
 		fmt.Printf("Failed to send Kafka records due to code:%s,response:%v\n", res.Status, res.Body)
+		config.stats.done(start, noOfLogs, noOfLogs, len(kafkaData))
+		config.stats.fail(fmt.Sprintf("http %d", res.StatusCode), noOfLogs)
+		countTemplates(config.stats, templates, allRecords)
+		return
 	}
+	countSent(len(kafkaData), len(body))
+	config.stats.done(start, noOfLogs, 0, len(kafkaData))
+	countTemplates(config.stats, templates, noRecords)
 }
 
-func generateLogsForOneMinute(startTime time.Time, config *Config, allLogs []string, topicName string) {
+func generateLogsForOneMinute(startTime time.Time, config *Config, allLogs []logLine, topicName string, r *rand.Rand, stop <-chan struct{}) {
 
-	totalLogsToSend := int(config.LogsPerMin)
-	sizeCheckCounter := 0
+	logsPerMin := control.logsPerMin(config)
+	totalLogsToSend := int(logsPerMin)
 
-	for range time.Tick(time.Duration(config.FlushInterval) * time.Second) {
+	ticker := time.NewTicker(time.Duration(config.FlushInterval) * time.Second)
+	defer ticker.Stop()
+	tally := make(genTally)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
 
-		logsToSendInThisFlush := int(math.Ceil((float64(config.LogsPerMin) / float64(60/config.FlushInterval))))
-		logsToSend := make([]map[string]interface{}, 0)
+		logsToSendInThisFlush := int(math.Ceil((float64(logsPerMin) / float64(60/config.FlushInterval))))
+		if control.isPaused() {
+			// the logs of a paused flush are skipped, not caught up on
+			totalLogsToSend -= logsToSendInThisFlush
+			if totalLogsToSend <= 0 {
+				return
+			}
+			continue
+		}
+		batch := newRecordBatch(config)
 
 		for {
 
-			logsToSend = append(logsToSend, getRandomLog(allLogs, config))
-			sendToFile(logsToSend, config)
+			kafkaRecord, line := getRandomLog(allLogs, config, r)
+			record, err := json.Marshal(kafkaRecord)
+			if err != nil {
+				log.Print(err)
+				os.Exit(1)
+			}
+			tally.add(genKey{config.statsName(), line.template, line.level}, len(record))
+
+			batch.add(record, line.template)
+			if config.SaveLogsToFile == "true" {
+				batch.lines = append(batch.lines, logFileLine(config, kafkaRecord)...)
+			}
 			logsToSendInThisFlush--
 			totalLogsToSend--
-			sizeCheckCounter++
 
-			if func() bool {
-
-				if logsToSendInThisFlush <= 0 {
-					return true
-				}
-
-				if len(logsToSend) >= int(config.MaxBulkCount) {
-					return true
-				}
-
-				kafkaRecords := make(map[string]interface{})
-				kafkaRecords["records"] = logsToSend
-
-				if math.Mod(float64(sizeCheckCounter), 10.0) == 0 {
-					kafkaData, err := json.Marshal(kafkaRecords)
-					if err != nil {
-						log.Print(err)
-						os.Exit(1)
-					}
-
-					size := len(kafkaData)
-
-					if size >= int(config.MaxBulkSize) {
-						return true
-					}
+			if logsToSendInThisFlush <= 0 ||
+				batch.records >= int(config.MaxBulkCount) ||
+				(config.MaxBulkSize > 0 && batch.size() >= int(config.MaxBulkSize)) {
+
+				tally.flush()
+				kafkaData := batch.body()
+				sendToFile(batch.lines, batch.templates, config)
+				if config.stats.enabled() {
+					sends.Add(1)
+					go func(templates []string) {
+						defer sends.Done()
+						sendToKafka(kafkaData, templates, config, topicName)
+					}(batch.templates)
+				} else {
+					// records are dropped while the topic is disabled through
+					// the control API
+					config.stats.drop(batch.records, len(kafkaData))
+					config.stats.fail("disabled", batch.records)
+					countTemplates(config.stats, batch.templates, allRecords)
 				}
-
-				return false
-			}() {
-
-				copyOfLogsToSend := make([]map[string]interface{}, len(logsToSend))
-				copy(copyOfLogsToSend, logsToSend)
-				logsToSend = make([]map[string]interface{}, 0)
-
-				go sendToKafka(copyOfLogsToSend, config, topicName)
+				batch = newRecordBatch(config)
 
 				if totalLogsToSend <= 0 {
-					fmt.Printf("Completed sending %d logs to kafka in %f minutes\n", int(config.LogsPerMin)-totalLogsToSend, time.Since(startTime).Minutes())
+					progressf("Completed sending %d logs to kafka in %f minutes\n", int(logsPerMin)-totalLogsToSend, time.Since(startTime).Minutes())
 					return
 				} else if logsToSendInThisFlush <= 0 {
 					break
@@ -222,15 +614,15 @@ func generateLogsForOneMinute(startTime time.Time, config *Config, allLogs []str
 	}
 }
 
-func processLogTemlates(args []string) []string {
-
-	var allLogs []string
+// loadTemplateFiles returns the lines of the template files, lines that are
+// not in the template format are skipped.
+func loadTemplateFiles(paths []string) []logLine {
 
-	noOfLogTemplates := len(args) - 2
+	var allLogs []logLine
 
-	for i := 0; i < noOfLogTemplates; i++ {
+	for _, path := range paths {
 
-		file, err := os.Open(args[i+2])
+		file, err := os.Open(path)
 
 		if err != nil {
 			log.Fatal(err)
@@ -241,6 +633,9 @@ func processLogTemlates(args []string) []string {
 
 		reader := bufio.NewReader(file)
 
+		// continuing is set while the lines continue the message of the last
+		// template of the file
+		continuing := false
 		for {
 
 			line, err := reader.ReadString('\n')
@@ -250,16 +645,25 @@ func processLogTemlates(args []string) []string {
 				log.Fatal(err)
 			}
 
-			allLogs = append(allLogs, strings.TrimSpace(line))
+			if text, ok := continuation(line); ok && continuing {
+				allLogs[len(allLogs)-1].message += "\n" + text
+				continue
+			}
+
+			logLine, ok := parseLogLine(filepath.Base(path), strings.TrimSpace(line))
+			if ok {
+				allLogs = append(allLogs, logLine)
+			}
+			continuing = ok
 		}
 	}
 
 	return allLogs
 }
 
-func loadConfig(path string) (*Config, error) {
+func loadConfig(path string, o overrides) (*Config, error) {
 
-	data, err := ioutil.ReadFile(path)
+	data, err := readConfigFile(path, o)
 	if err != nil {
 		return nil, err
 	}
@@ -273,31 +677,233 @@ func loadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
-func main() {
+// setupTopics checks the config and returns the config and log templates of
+// every topic.
+func setupTopics(config *Config, templatePaths []string) ([]*Config, [][]logLine, error) {
 
-	args := os.Args
-	if len(args) < 3 {
-		fmt.Println("Insufficient arguments")
-		return
+	if len(config.KafkaTopics) <= 0 {
+		return nil, nil, errors.New("'kafka_topics' is empty")
 	}
 
-	config, err := loadConfig(args[1])
-	if err != nil {
-		fmt.Println(err)
-		return
+	if config.FlushInterval == 0 || config.FlushInterval > 60 {
+		return nil, nil, fmt.Errorf("'flush_interval' has to be between 1 and 60, got %d", config.FlushInterval)
 	}
 
-	if len(config.KafkaTopics) <= 0 || config.FlushInterval > 60 || config.MaxBulkCount > config.LogsPerMin {
-		fmt.Println("Either 'kafka_topics is empty' or 'flush_interval is greater than 60' or 'max_bulk_count is greater than logs_per_min'")
-		return
+	if config.RestAPIVersion != "" && config.RestAPIVersion != "v2" && config.RestAPIVersion != "v3" {
+		return nil, nil, errors.New("'rest_api_version' has to be either v2 or v3")
+	}
+
+	if err := checkCompression(config.Compression); err != nil {
+		return nil, nil, err
+	}
+
+	if err := config.Thresholds.validate(); err != nil {
+		return nil, nil, err
 	}
 
-	allLogs := processLogTemlates(args)
+	// template files of the config are used along with those passed as
+	// arguments by topics without their own
+	allLogs := loadTemplateFiles(append(append([]string{}, templatePaths...), config.TemplateFiles...))
 
-	for range time.Tick(time.Minute) {
-		for _, topicName := range config.KafkaTopics {
-			fmt.Printf("Starting to send 1 minute logs to topic %s\n", topicName)
-			go generateLogsForOneMinute(time.Now(), config, allLogs, topicName)
+	topicConfigs := make([]*Config, 0, len(config.KafkaTopics))
+	topicLogs := make([][]logLine, 0, len(config.KafkaTopics))
+
+	for _, topic := range config.KafkaTopics {
+		topicConfig := config.forTopic(topic)
+
+		if topic.Name == "" {
+			return nil, nil, errors.New("Every entry in 'kafka_topics' needs a name")
+		}
+
+		// reloads match topics by name
+		for _, other := range topicConfigs {
+			if other.KafkaTopics[0].Name == topic.Name {
+				return nil, nil, fmt.Errorf("Topic %s is in 'kafka_topics' more than once", topic.Name)
+			}
+		}
+
+		if topicConfig.MaxBulkCount > topicConfig.LogsPerMin {
+			return nil, nil, fmt.Errorf("'max_bulk_count is greater than logs_per_min' for topic %s", topic.Name)
+		}
+
+		if len(topicConfig.Headers) > 0 && topicConfig.RestAPIVersion != "v3" {
+			fmt.Printf("Kafka REST v2 does not support record headers, 'headers' are ignored for topic %s. Set 'rest_api_version' to v3 to send them\n", topic.Name)
+		}
+
+		logs := allLogs
+		if len(topic.TemplateFiles) > 0 {
+			logs = loadTemplateFiles(topic.TemplateFiles)
+		}
+
+		if len(logs) == 0 {
+			return nil, nil, fmt.Errorf("No log templates for topic %s, pass template files as arguments or set 'template_files'", topic.Name)
+		}
+
+		topicConfigs = append(topicConfigs, topicConfig)
+		topicLogs = append(topicLogs, logs)
+	}
+
+	return topicConfigs, topicLogs, nil
+}
+
+// runOptions are the run command flags that are not config fields.
+type runOptions struct {
+	seed          int64
+	statsInterval time.Duration
+	// duration ends the run, which otherwise runs until interrupted
+	duration time.Duration
+	// metricsAddr is the listen address of the /metrics endpoint, if any
+	metricsAddr string
+	// report is the file the JSON run report is written to, if any
+	report string
+	// controlAddr is the listen address of the control API, if any
+	controlAddr string
+	// overrides are applied again on reload, watch reloads when the config
+	// or template files change
+	overrides overrides
+	watch     bool
+	// stop ends the run like an interrupt, done is handed the report of the
+	// run, both are set for workers of a distributed run
+	stop <-chan struct{}
+	done func(report *runReport)
+}
+
+// stopSignal returns a channel that is closed on SIGINT or SIGTERM, once
+// duration has passed if it is not 0, or when also is closed.
+func stopSignal(duration time.Duration, also <-chan struct{}) <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		var timeout <-chan time.Time
+		if duration > 0 {
+			timeout = time.After(duration)
+		}
+		select {
+		case <-signals:
+		case <-timeout:
+		case <-also:
+		}
+		// a second interrupt kills the process
+		signal.Stop(signals)
+		close(stop)
+	}()
+	return stop
+}
+
+// runGenerator sends the logs of every topic of gens once a minute,
+// printing the status of every sink each statsInterval and swapping in
+// reloaded configs between minutes, until the run is stopped. It then waits
+// for the requests in flight, prints the summary of the run, checks the
+// thresholds and writes the run report if asked.
+func runGenerator(gens []*generator, opts runOptions) error {
+
+	seed := opts.seed
+	stop := stopSignal(opts.duration, opts.stop)
+
+	for _, g := range gens {
+		for _, topicConfig := range g.configs {
+			topicConfig.stats = newSinkStats("kafka " + topicConfig.statsName())
 		}
+		for _, topicConfig := range g.configs {
+			if topicConfig.SaveLogsToFile == "true" {
+				topicConfig.fileStats = fileSink()
+			}
+		}
+	}
+	setRunning(allTopicConfigs(gens))
+	if opts.metricsAddr != "" {
+		if err := serveMetrics(opts.metricsAddr); err != nil {
+			return err
+		}
+	}
+	if opts.controlAddr != "" {
+		if err := serveControl(opts.controlAddr); err != nil {
+			return err
+		}
+	}
+	if !quiet && opts.statsInterval > 0 {
+		go reportStatus(opts.statsInterval, stop)
 	}
+
+	fmt.Printf("Using seed %d\n", seed)
+	if len(gens) > 1 || gens[0].name != "" {
+		fmt.Printf("Running %d definitions with %d topics\n", len(gens), len(allTopicConfigs(gens)))
+	}
+
+	reloads := make(chan *generator)
+	for _, g := range gens {
+		watchConfig(g, opts.overrides, opts.watch, stop, reloads)
+	}
+	start := time.Now()
+	ticker := time.NewTicker(time.Minute)
+	var workers sync.WaitGroup
+	var generating time.Time
+	minute := 0
+loop:
+	for {
+		select {
+		case <-stop:
+			break loop
+		case loaded := <-reloads:
+			for i, g := range gens {
+				if g.name == loaded.name {
+					swapConfig(g, loaded)
+					gens[i] = loaded
+				}
+			}
+			setRunning(allTopicConfigs(gens))
+			fmt.Printf("Reloaded %s, %d topics, changes apply from the next minute\n", loaded.path, len(loaded.configs))
+			continue
+		case <-ticker.C:
+		}
+		if minute == 0 {
+			generating = time.Now()
+		}
+		for _, g := range gens {
+			for i, topicConfig := range g.configs {
+				progressf("Starting to send 1 minute logs to topic %s\n", topicConfig.statsName())
+				r := rand.New(rand.NewSource(workerSeed(definitionSeed(seed, g.name), i, minute)))
+				workers.Add(1)
+				go func(topicConfig *Config, logs []logLine) {
+					defer workers.Done()
+					generateLogsForOneMinute(time.Now(), topicConfig, logs, topicConfig.KafkaTopics[0].Name, r, stop)
+				}(topicConfig, g.logs[i])
+			}
+		}
+		minute++
+	}
+	ticker.Stop()
+
+	workers.Wait()
+	sends.Wait()
+	end := time.Now()
+	printSummary(end.Sub(start))
+
+	report := buildReport(gens, seed, start, generating, end)
+	report.Thresholds = checkThresholds(gens, report)
+	for _, g := range gens {
+		if g.config.Thresholds != nil {
+			printThresholds(report.Thresholds)
+			break
+		}
+	}
+	if opts.done != nil {
+		opts.done(report)
+	}
+	if opts.report != "" {
+		if err := writeReport(opts.report, report); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote run report to %s\n", opts.report)
+	}
+	if !report.Thresholds.Passed {
+		return errThresholdsViolated
+	}
+	return nil
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
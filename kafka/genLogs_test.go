@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want logLine
+		ok   bool
+	}{
+		{"level=INFO, message = started", logLine{"t", "info", "started"}, true},
+		{"level = Warn ,message=disk at $INT%", logLine{"t", "warn", "disk at $INT%"}, true},
+		{"level=error, message = a=b, c=d", logLine{"t", "error", "a=b, c=d"}, true},
+		{"level=INFO  message = no comma", logLine{}, false},
+		{"level INFO, message = no equals", logLine{}, false},
+		{"level=INFO, no message", logLine{}, false},
+		{"", logLine{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseLogLine("t", tt.line)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseLogLine(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExpandRecordExpression(t *testing.T) {
+	record := map[string]interface{}{
+		"_tag_appName": "billing",
+		"level":        "error",
+		"message":      "bad ${field} in ${_tag_appName}",
+		"self":         "${self}",
+		"count":        3,
+	}
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"${_tag_appName}-${level}", "billing-error"},
+		{"${message}", "bad ${field} in ${_tag_appName}"},
+		{"${self}/${self}", "${self}/${self}"},
+		{"${missing}x", "x"},
+		{"n=${count}", "n=3"},
+		{"open ${level", "open ${level"},
+		{"static", "static"},
+	}
+	for _, tt := range tests {
+		if got := expandRecordExpression(tt.expr, record, rand.New(rand.NewSource(1))); got != tt.want {
+			t.Errorf("expandRecordExpression(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistIndex(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want int
+	}{
+		{0, 0},
+		{1, 1},
+		{127, 127},
+		{128, 128},
+		{129, 128},
+		{130, 129},
+		{255, 191},
+		{256, 192},
+		{histMax, histBuckets - 1},
+		{histMax + 1, histBuckets - 1},
+		{1 << 63, histBuckets - 1},
+	}
+	for _, tt := range tests {
+		if got := histIndex(tt.v); got != tt.want {
+			t.Errorf("histIndex(%d) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestHistValue(t *testing.T) {
+	tests := []struct {
+		i    int
+		want uint64
+	}{
+		{0, 0},
+		{127, 127},
+		{128, 129},
+		{129, 131},
+		{191, 255},
+		{192, 259},
+		{histBuckets - 1, histMax},
+	}
+	for _, tt := range tests {
+		if got := histValue(tt.i); got != tt.want {
+			t.Errorf("histValue(%d) = %d, want %d", tt.i, got, tt.want)
+		}
+	}
+}
+
+// TestHistBuckets checks every value falls into a bucket whose highest value
+// is at least the value and off by less than 1/histSub.
+func TestHistBuckets(t *testing.T) {
+	for _, v := range []uint64{0, 1, 63, 64, 127, 128, 1000, 65535, 1e6, 123456789, 1e12, histMax} {
+		high := histValue(histIndex(v))
+		if high < v || float64(high-v) > float64(v)/histSub {
+			t.Errorf("value %d falls into a bucket up to %d", v, high)
+		}
+	}
+}
+
+func TestHistQuantile(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	s := h.whole()
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 1 * time.Millisecond},
+		{0.5, 50 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := s.quantile(tt.q)
+		if diff := got - tt.want; diff < 0 || float64(diff) > float64(tt.want)/histSub {
+			t.Errorf("quantile(%v) = %v, want %v within 1/%d", tt.q, got, tt.want, histSub)
+		}
+	}
+	if got := (&histSnapshot{}).quantile(0.5); got != 0 {
+		t.Errorf("quantile of an empty histogram = %v, want 0", got)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket bounds of the exported histograms.
+var (
+	latencyBounds      = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	batchRecordsBounds = []float64{1, 10, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	batchBytesBounds   = []float64{1 << 10, 10 << 10, 100 << 10, 512 << 10, 1 << 20, 5 << 20, 10 << 20, 50 << 20}
+)
+
+// rateWindow is how many seconds the actual rate is measured over.
+const rateWindow = 10
+
+// rateSampler keeps the generated record totals by topic of the last
+// rateWindow seconds.
+type rateSampler struct {
+	mu      sync.Mutex
+	samples []map[string]uint64
+}
+
+func (rs *rateSampler) sample() {
+	totals := make(map[string]uint64)
+	for key, c := range generatedCounts() {
+		totals[key.topic] += c.records
+	}
+
+	rs.mu.Lock()
+	rs.samples = append(rs.samples, totals)
+	if len(rs.samples) > rateWindow+1 {
+		rs.samples = rs.samples[1:]
+	}
+	rs.mu.Unlock()
+}
+
+// rate returns the records per second generated for topic over the window.
+func (rs *rateSampler) rate(topic string) float64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.samples) < 2 {
+		return 0
+	}
+	first, last := rs.samples[0], rs.samples[len(rs.samples)-1]
+	return float64(last[topic]-first[topic]) / float64(len(rs.samples)-1)
+}
+
+// serveMetrics exports the run statistics in the Prometheus text format on
+// addr under /metrics until the process exits.
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	rates := &rateSampler{}
+	go func() {
+		for range time.Tick(time.Second) {
+			rates.sample()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, runningConfigs(), rates)
+	})
+	fmt.Printf("Serving metrics on http://%s/metrics\n", listener.Addr())
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	return nil
+}
+
+func writeMetrics(out io.Writer, topicConfigs []*Config, rates *rateSampler) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	current := allSinks()
+
+	counts := generatedCounts()
+	keys := make([]genKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.topic != b.topic {
+			return a.topic < b.topic
+		}
+		if a.template != b.template {
+			return a.template < b.template
+		}
+		return a.level < b.level
+	})
+
+	metricHeader(w, "loggen_generated_records_total", "counter", "Records generated by topic, template file and level.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "loggen_generated_records_total%s %d\n", labels("topic", key.topic, "template", key.template, "level", key.level), counts[key].records)
+	}
+	metricHeader(w, "loggen_generated_bytes_total", "counter", "Encoded bytes of the generated records by topic, template file and level.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "loggen_generated_bytes_total%s %d\n", labels("topic", key.topic, "template", key.template, "level", key.level), counts[key].bytes)
+	}
+
+	sinkCounter := func(name string, kind string, help string, value func(s *sinkStats) int64) {
+		metricHeader(w, name, kind, help)
+		for _, s := range current {
+			fmt.Fprintf(w, "%s%s %d\n", name, labels("sink", s.name), value(s))
+		}
+	}
+	sinkCounter("loggen_sent_records_total", "counter", "Records a sink accepted.", func(s *sinkStats) int64 { return int64(atomic.LoadUint64(&s.sent)) })
+	sinkCounter("loggen_sent_bytes_total", "counter", "Uncompressed bytes of the records a sink accepted.", func(s *sinkStats) int64 { return int64(atomic.LoadUint64(&s.bytes)) })
+	sinkCounter("loggen_failed_records_total", "counter", "Records a sink did not accept.", func(s *sinkStats) int64 { return int64(atomic.LoadUint64(&s.failed)) })
+	sinkCounter("loggen_dropped_records_total", "counter", "Records that never made it into a request.", func(s *sinkStats) int64 { return int64(atomic.LoadUint64(&s.dropped)) })
+	sinkCounter("loggen_dropped_bytes_total", "counter", "Bytes of the records that never made it into a request.", func(s *sinkStats) int64 { return int64(atomic.LoadUint64(&s.droppedBytes)) })
+	sinkCounter("loggen_in_flight_requests", "gauge", "Requests waiting for a response, the send queue depth.", func(s *sinkStats) int64 { return atomic.LoadInt64(&s.inFlight) })
+
+	templateCounter := func(name string, help string, value func(c templateCount) uint64) {
+		metricHeader(w, name, "counter", help)
+		for _, s := range current {
+			counts := s.templateCounts()
+			templates := make([]string, 0, len(counts))
+			for template := range counts {
+				templates = append(templates, template)
+			}
+			sort.Strings(templates)
+			for _, template := range templates {
+				fmt.Fprintf(w, "%s%s %d\n", name, labels("sink", s.name, "template", template), value(counts[template]))
+			}
+		}
+	}
+	templateCounter("loggen_template_sent_records_total", "Records a sink accepted by template file.", func(c templateCount) uint64 { return c.Sent })
+	templateCounter("loggen_template_failed_records_total", "Records a sink did not accept or dropped by template file.", func(c templateCount) uint64 { return c.Failed })
+
+	metricHeader(w, "loggen_request_duration_seconds", "histogram", "Request latency by sink and outcome.")
+	for _, s := range current {
+		for outcome := 0; outcome < outcomes; outcome++ {
+			writeHistogram(w, "loggen_request_duration_seconds", []string{"sink", s.name, "outcome", outcomeNames[outcome]}, s.latency[outcome].whole(), latencyBounds, 1e9)
+		}
+	}
+	metricHeader(w, "loggen_batch_records", "histogram", "Records per request.")
+	for _, s := range current {
+		writeHistogram(w, "loggen_batch_records", []string{"sink", s.name}, s.batchRecords.whole(), batchRecordsBounds, 1)
+	}
+	metricHeader(w, "loggen_batch_bytes", "histogram", "Uncompressed bytes per request.")
+	for _, s := range current {
+		writeHistogram(w, "loggen_batch_bytes", []string{"sink", s.name}, s.batchBytes.whole(), batchBytesBounds, 1)
+	}
+
+	metricHeader(w, "loggen_target_rate_records_per_second", "gauge", "logs_per_min of the topic per second, as changed through the control API.")
+	for _, topicConfig := range topicConfigs {
+		fmt.Fprintf(w, "loggen_target_rate_records_per_second%s %s\n", labels("topic", topicConfig.statsName()), formatFloat(float64(control.logsPerMin(topicConfig))/60))
+	}
+	metricHeader(w, "loggen_actual_rate_records_per_second", "gauge", fmt.Sprintf("Records generated for the topic per second over the last %d seconds.", rateWindow))
+	for _, topicConfig := range topicConfigs {
+		topic := topicConfig.statsName()
+		fmt.Fprintf(w, "loggen_actual_rate_records_per_second%s %s\n", labels("topic", topic), formatFloat(rates.rate(topic)))
+	}
+
+	metricHeader(w, "loggen_uncompressed_bytes_total", "counter", "Request body bytes before compression.")
+	fmt.Fprintf(w, "loggen_uncompressed_bytes_total %d\n", atomic.LoadUint64(&uncompressedBytes))
+	metricHeader(w, "loggen_wire_bytes_total", "counter", "Request body bytes after compression.")
+	fmt.Fprintf(w, "loggen_wire_bytes_total %d\n", atomic.LoadUint64(&sentBytes))
+}
+
+func metricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeHistogram writes the buckets, sum and count of a histogram. Values
+// are divided by scale, e.g. 1e9 for seconds from nanoseconds.
+func writeHistogram(w io.Writer, name string, labelPairs []string, s *histSnapshot, bounds []float64, scale float64) {
+	raw := make([]uint64, len(bounds))
+	for i, bound := range bounds {
+		raw[i] = uint64(bound * scale)
+	}
+	for i, count := range s.cumulative(raw) {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(append(labelPairs, "le", formatFloat(bounds[i]))...), count)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(append(labelPairs, "le", "+Inf")...), s.total)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels(labelPairs...), formatFloat(float64(s.sum)/scale))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels(labelPairs...), s.total)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name, value pairs as a label set.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
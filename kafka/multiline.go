@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// continuation tells whether a template file line continues the message of
+// the template above it and returns the text it adds as a new line of the
+// message. Lines starting with a space or a tab continue a message, the
+// first space is dropped so " ValueError: bad" adds an unindented line while
+// tabs are kept for Java style "\tat" frames. Indented template lines start
+// a template of their own.
+func continuation(line string) (string, bool) {
+	if line == "" || (line[0] != ' ' && line[0] != '\t') {
+		return "", false
+	}
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || (strings.HasPrefix(strings.ToLower(trimmed), "level") && strings.Contains(trimmed, ",")) {
+		return "", false
+	}
+	return strings.TrimPrefix(strings.TrimRight(line, " \t\r\n"), " "), true
+}
+
+// stackTraces are the placeholders of exceptions with a random number of
+// frames. A trace starts on a new line below the message, the way logging
+// libraries print them.
+var stackTraces = []struct {
+	placeholder string
+	build       func(r *rand.Rand) string
+}{
+	{"$JAVA_STACK", javaStack},
+	{"$PYTHON_STACK", pythonStack},
+	{"$GO_STACK", goStack},
+}
+
+// expandStackTraces replaces every stack trace placeholder of msg with a
+// trace of its own.
+func expandStackTraces(msg string, r *rand.Rand) string {
+	if !strings.Contains(msg, "_STACK") {
+		return msg
+	}
+	for _, st := range stackTraces {
+		for {
+			i := strings.Index(msg, st.placeholder)
+			if i == -1 {
+				break
+			}
+			msg = msg[:i] + st.build(r) + msg[i+len(st.placeholder):]
+		}
+	}
+	return msg
+}
+
+func pick(r *rand.Rand, names []string) string {
+	return names[r.Intn(len(names))]
+}
+
+var (
+	javaPackages   = []string{"com.acme.orders", "com.acme.billing", "com.acme.inventory", "io.shop.gateway", "io.shop.auth", "org.example.payments"}
+	javaClasses    = []string{"OrderService", "PaymentController", "InventoryRepository", "SessionManager", "RequestHandler", "CheckoutFacade", "TokenValidator", "PriceCalculator"}
+	javaMethods    = []string{"process", "handle", "execute", "lookup", "validate", "apply", "load", "save", "resolve", "invoke"}
+	javaExceptions = []string{
+		"java.lang.NullPointerException: Cannot invoke \"String.length()\" because \"value\" is null",
+		"java.lang.IllegalStateException: Connection pool exhausted",
+		"java.lang.IllegalArgumentException: Invalid order id",
+		"java.io.IOException: Connection reset by peer",
+		"java.util.concurrent.TimeoutException: Request timed out after 30000 ms",
+		"java.sql.SQLTransientConnectionException: HikariPool-1 - Connection is not available",
+	}
+	javaFrameworkFrames = []string{
+		"org.springframework.web.servlet.FrameworkServlet.service(FrameworkServlet.java:897)",
+		"jakarta.servlet.http.HttpServlet.service(HttpServlet.java:750)",
+		"org.apache.catalina.core.ApplicationFilterChain.doFilter(ApplicationFilterChain.java:166)",
+		"org.apache.tomcat.util.threads.ThreadPoolExecutor$Worker.run(ThreadPoolExecutor.java:659)",
+		"java.base/java.lang.Thread.run(Thread.java:833)",
+	}
+)
+
+func javaFrames(r *rand.Rand, depth int) string {
+	var b strings.Builder
+	for i := 0; i < depth; i++ {
+		class := pick(r, javaClasses)
+		if r.Intn(5) == 0 {
+			class += fmt.Sprintf("$%d", r.Intn(4)+1)
+		}
+		fmt.Fprintf(&b, "\n\tat %s.%s.%s(%s.java:%d)", pick(r, javaPackages), class, pick(r, javaMethods), strings.SplitN(class, "$", 2)[0], r.Intn(400)+10)
+	}
+	return b.String()
+}
+
+// javaStack returns an exception with 3 to 20 frames of its own, the frames
+// of the framework below them and sometimes a cause.
+func javaStack(r *rand.Rand) string {
+	trace := "\n" + pick(r, javaExceptions) + javaFrames(r, 3+r.Intn(18))
+	for _, frame := range javaFrameworkFrames[r.Intn(len(javaFrameworkFrames)):] {
+		trace += "\n\tat " + frame
+	}
+	if r.Intn(3) == 0 {
+		trace += "\nCaused by: " + pick(r, javaExceptions) + javaFrames(r, 1+r.Intn(5))
+		trace += fmt.Sprintf("\n\t... %d more", 2+r.Intn(20))
+	}
+	return trace
+}
+
+var (
+	pythonModules    = []string{"app/orders/service", "app/billing/client", "app/api/views", "app/workers/tasks", "lib/db/session", "lib/cache/redis"}
+	pythonFunctions  = []string{"process", "handle_request", "dispatch", "run_task", "fetch", "execute", "get_user", "charge"}
+	pythonStatements = []string{
+		"result = handler(request)",
+		"return self._session.execute(query)",
+		"data = json.loads(payload)",
+		"value = int(raw)",
+		"response.raise_for_status()",
+		"conn = self.pool.acquire(timeout=timeout)",
+		"return func(*args, **kwargs)",
+	}
+	pythonExceptions = []string{
+		"ValueError: invalid literal for int() with base 10: 'abc'",
+		"KeyError: 'user_id'",
+		"TypeError: 'NoneType' object is not subscriptable",
+		"ConnectionError: HTTPConnectionPool(host='payments', port=8080): Max retries exceeded",
+		"TimeoutError: timed out waiting for a connection",
+	}
+)
+
+// pythonStack returns a traceback with 2 to 12 frames.
+func pythonStack(r *rand.Rand) string {
+	trace := "\nTraceback (most recent call last):"
+	for depth := 2 + r.Intn(11); depth > 0; depth-- {
+		trace += fmt.Sprintf("\n  File \"/srv/%s.py\", line %d, in %s\n    %s",
+			pick(r, pythonModules), r.Intn(400)+1, pick(r, pythonFunctions), pick(r, pythonStatements))
+	}
+	return trace + "\n" + pick(r, pythonExceptions)
+}
+
+var (
+	goPackages  = []string{"github.com/acme/orders/internal/service", "github.com/acme/orders/internal/store", "github.com/acme/orders/internal/api", "github.com/acme/billing/pkg/client"}
+	goReceivers = []string{"(*Service)", "(*Store)", "(*Handler)", "(*Client)", ""}
+	goFunctions = []string{"Process", "Get", "ServeHTTP", "Charge", "decode", "lookup", "retry", "func1"}
+	goPanics    = []string{
+		"runtime error: invalid memory address or nil pointer dereference",
+		"runtime error: index out of range [5] with length 3",
+		"assignment to entry in nil map",
+		"send on closed channel",
+	}
+)
+
+// goStack returns a panic with a goroutine of 2 to 15 frames.
+func goStack(r *rand.Rand) string {
+	trace := fmt.Sprintf("\npanic: %s\n\ngoroutine %d [running]:", pick(r, goPanics), r.Intn(5000)+1)
+	for depth := 2 + r.Intn(14); depth > 0; depth-- {
+		pkg, fn := pick(r, goPackages), pick(r, goFunctions)
+		if receiver := pick(r, goReceivers); receiver != "" {
+			fn = receiver + "." + fn
+		}
+		trace += fmt.Sprintf("\n%s.%s(0xc%09x, 0x%x)\n\t/src/%s/%s.go:%d +0x%x",
+			pkg, fn, r.Intn(1<<30), r.Intn(256), strings.TrimPrefix(pkg, "github.com/"), strings.ToLower(pick(r, goFunctions)), r.Intn(400)+1, r.Intn(0x400))
+	}
+	return trace + "\ncreated by net/http.(*Server).Serve in goroutine 1\n\t/usr/local/go/src/net/http/server.go:3285 +0x4b4"
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often -watch looks at the config and template files.
+const watchInterval = 2 * time.Second
+
+// running holds the config being generated for the metrics and control
+// API, runGenerator swaps it on reload.
+var running struct {
+	sync.Mutex
+	configs []*Config
+}
+
+func setRunning(configs []*Config) {
+	running.Lock()
+	running.configs = configs
+	running.Unlock()
+}
+
+// runningConfigs returns the config of every topic being generated.
+func runningConfigs() []*Config {
+	running.Lock()
+	defer running.Unlock()
+	return running.configs
+}
+
+// removed holds the last config of every topic a reload removed by name, so
+// the report keeps the records generated and sent for it.
+var removed struct {
+	sync.Mutex
+	configs map[string]*Config
+}
+
+// removedConfigs returns the configs of the topics reloads removed, sorted
+// by name.
+func removedConfigs() []*Config {
+	removed.Lock()
+	defer removed.Unlock()
+	names := make([]string, 0, len(removed.configs))
+	for name := range removed.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	configs := make([]*Config, len(names))
+	for i, name := range names {
+		configs[i] = removed.configs[name]
+	}
+	return configs
+}
+
+// swapConfig carries the log_index counter and stats of every topic of
+// current that is still there over to loaded, and keeps the config of every
+// topic loaded removes for the report.
+func swapConfig(current, loaded *generator) {
+	previous := make(map[string]*Config, len(current.configs))
+	for _, topicConfig := range current.configs {
+		previous[topicConfig.statsName()] = topicConfig
+	}
+	removed.Lock()
+	defer removed.Unlock()
+	if removed.configs == nil {
+		removed.configs = make(map[string]*Config)
+	}
+	for _, topicConfig := range loaded.configs {
+		name := topicConfig.statsName()
+		if old := previous[name]; old != nil {
+			topicConfig.logIndex = old.logIndex
+			topicConfig.stats = old.stats
+			delete(previous, name)
+		} else {
+			topicConfig.stats = sinkNamed("kafka " + name)
+		}
+		delete(removed.configs, name)
+		if topicConfig.SaveLogsToFile == "true" {
+			topicConfig.fileStats = fileSink()
+		}
+	}
+	for name, topicConfig := range previous {
+		removed.configs[name] = topicConfig
+		fmt.Printf("Topic %s was removed, its statistics stay in the report\n", name)
+	}
+}
+
+// modTimes returns the modification time of every file, zero for files that
+// can not be read.
+func modTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			times[file] = info.ModTime()
+		} else {
+			times[file] = time.Time{}
+		}
+	}
+	return times
+}
+
+// watchConfig reloads the config and template files of g on SIGHUP, and
+// whenever they change if watch is set, until stop is closed. Generators
+// that pass the checks are sent on reloads, the others are reported and
+// dropped.
+func watchConfig(g *generator, o overrides, watch bool, stop <-chan struct{}, reloads chan<- *generator) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hangup)
+		var tick <-chan time.Time
+		if watch {
+			ticker := time.NewTicker(watchInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		files := g.watchedFiles()
+		times := modTimes(files)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-hangup:
+				fmt.Printf("Reloading %s on SIGHUP\n", g.path)
+			case <-tick:
+				current := modTimes(files)
+				if reflect.DeepEqual(current, times) {
+					continue
+				}
+				times = current
+				fmt.Printf("Config or template files of %s changed, reloading\n", g.path)
+			}
+
+			if p := validateFiles(g.name, g.path, g.templatePaths, o); p.failed() > 0 {
+				for _, problem := range p {
+					fmt.Println(problem)
+				}
+				fmt.Printf("Reload of %s failed validation, keeping the running config\n", g.path)
+				continue
+			}
+			loaded, err := loadGenerator(g.name, g.path, g.templatePaths, o)
+			if err != nil {
+				fmt.Printf("Reload of %s failed, keeping the running config: %v\n", g.path, err)
+				continue
+			}
+			g = loaded
+			files = g.watchedFiles()
+			times = modTimes(files)
+
+			select {
+			case reloads <- loaded:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
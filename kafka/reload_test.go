@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSwapConfigRemovedTopics(t *testing.T) {
+	topic := func(name string) *Config {
+		return &Config{definition: "swap", KafkaTopics: []TopicConfig{{Name: name}}}
+	}
+	current := &generator{name: "swap", configs: []*Config{topic("a"), topic("b")}}
+	for _, topicConfig := range current.configs {
+		topicConfig.stats = sinkNamed("kafka " + topicConfig.statsName())
+	}
+	current.configs[1].stats.done(current.configs[1].stats.begin(), 10, 0, 100)
+
+	loaded := &generator{name: "swap", configs: []*Config{topic("a")}}
+	swapConfig(current, loaded)
+	if loaded.configs[0].stats != current.configs[0].stats {
+		t.Error("the stats of a kept topic were not carried over")
+	}
+	if got := removedConfigs(); len(got) != 1 || got[0].statsName() != "swap/b" {
+		t.Fatalf("removedConfigs = %v, want swap/b", got)
+	}
+
+	again := &generator{name: "swap", configs: []*Config{topic("a"), topic("b")}}
+	swapConfig(loaded, again)
+	if len(removedConfigs()) != 0 {
+		t.Error("a topic added back is still removed")
+	}
+	if sent := again.configs[1].stats.sent; sent != 10 {
+		t.Errorf("a topic added back sent %d records, want the 10 sent before it was removed", sent)
+	}
+}
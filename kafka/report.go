@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runReport is the JSON report of a run written by -report. Maps are keyed
+// by name so reports of different runs can be diffed.
+type runReport struct {
+	ConfigDigest   string                  `json:"config_digest"`
+	Seed           int64                   `json:"seed"`
+	Start          time.Time               `json:"start"`
+	End            time.Time               `json:"end"`
+	ElapsedSeconds float64                 `json:"elapsed_seconds"`
+	Sinks          map[string]*sinkReport  `json:"sinks"`
+	Rates          map[string]*rateReport  `json:"rates"`
+	Generated      map[string]*countReport `json:"generated"`
+	Templates      map[string]*countReport `json:"templates"`
+	Levels         map[string]*countReport `json:"levels"`
+	Thresholds     *thresholdReport        `json:"thresholds"`
+	// Definitions is only set for a definitions directory run
+	Definitions map[string]*definitionReport `json:"definitions,omitempty"`
+	// Workers is only set for a distributed run
+	Workers []*workerReport `json:"workers,omitempty"`
+}
+
+// definitionReport sums up the topics of a definition. Its sinks, rates and
+// generated counts are those prefixed by its name.
+type definitionReport struct {
+	ConfigDigest string   `json:"config_digest"`
+	Topics       []string `json:"topics"`
+	// RemovedTopics are the topics a reload removed during the run, they
+	// count towards the totals
+	RemovedTopics []string     `json:"removed_topics,omitempty"`
+	Generated     *countReport `json:"generated"`
+	Sent          uint64       `json:"sent"`
+	Failed        uint64       `json:"failed"`
+	Dropped       uint64       `json:"dropped"`
+}
+
+type sinkReport struct {
+	Sent         uint64                    `json:"sent"`
+	Failed       uint64                    `json:"failed"`
+	Dropped      uint64                    `json:"dropped"`
+	Bytes        uint64                    `json:"bytes"`
+	DroppedBytes uint64                    `json:"dropped_bytes"`
+	Errors       map[string]uint64         `json:"errors"`
+	Latency      map[string]*latencyReport `json:"latency"`
+	// Removed is set for the topics a reload removed during the run
+	Removed bool `json:"removed,omitempty"`
+}
+
+// latencyReport holds the request latency of an outcome in milliseconds.
+type latencyReport struct {
+	Requests  uint64             `json:"requests"`
+	Quantiles map[string]float64 `json:"quantiles_ms"`
+	Max       float64            `json:"max_ms"`
+}
+
+// rateReport compares the records generated per second for a topic since
+// the first minute started with its logs_per_min.
+type rateReport struct {
+	Target    float64 `json:"target_per_second"`
+	Actual    float64 `json:"actual_per_second"`
+	Adherence float64 `json:"adherence"`
+	// MeasuredSeconds is the time since the first minute started, 0 if
+	// none did
+	MeasuredSeconds float64 `json:"measured_seconds"`
+	// Removed is set for the topics a reload removed during the run, their
+	// rate is measured over the whole run
+	Removed bool `json:"removed,omitempty"`
+}
+
+type countReport struct {
+	Records uint64 `json:"records"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func (c *countReport) add(n genCount) {
+	c.Records += n.records
+	c.Bytes += n.bytes
+}
+
+func addCount(m map[string]*countReport, key string, n genCount) {
+	if m[key] == nil {
+		m[key] = &countReport{}
+	}
+	m[key].add(n)
+}
+
+// configDigest returns the sha256 of the config as it was run, after
+// overrides.
+func configDigest(config *Config) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func latencyOf(h *histSnapshot) *latencyReport {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	l := &latencyReport{Requests: h.total, Quantiles: make(map[string]float64), Max: ms(time.Duration(h.max))}
+	for _, q := range latencyQuantiles {
+		l.Quantiles[q.name] = ms(h.quantile(q.q))
+	}
+	return l
+}
+
+// buildReport collects the statistics of a run that started at start and
+// generated records since generating, which is zero if no minute started.
+func buildReport(gens []*generator, seed int64, start, generating, end time.Time) *runReport {
+	report := &runReport{
+		ConfigDigest:   digest(gens),
+		Seed:           seed,
+		Start:          start,
+		End:            end,
+		ElapsedSeconds: end.Sub(start).Seconds(),
+		Sinks:          make(map[string]*sinkReport),
+		Rates:          make(map[string]*rateReport),
+		Generated:      make(map[string]*countReport),
+		Templates:      make(map[string]*countReport),
+		Levels:         make(map[string]*countReport),
+	}
+
+	for _, s := range allSinks() {
+		sink := &sinkReport{
+			Sent:         atomic.LoadUint64(&s.sent),
+			Failed:       atomic.LoadUint64(&s.failed),
+			Dropped:      atomic.LoadUint64(&s.dropped),
+			Bytes:        atomic.LoadUint64(&s.bytes),
+			DroppedBytes: atomic.LoadUint64(&s.droppedBytes),
+			Errors:       s.errorCounts(),
+			Latency:      make(map[string]*latencyReport),
+		}
+		all := &histSnapshot{}
+		for outcome := 0; outcome < outcomes; outcome++ {
+			h := s.latency[outcome].whole()
+			all = all.merge(h)
+			if h.total > 0 {
+				sink.Latency[outcomeNames[outcome]] = latencyOf(h)
+			}
+		}
+		if all.total > 0 {
+			sink.Latency["all"] = latencyOf(all)
+		}
+		report.Sinks[s.name] = sink
+	}
+
+	for key, n := range generatedCounts() {
+		addCount(report.Generated, key.topic, n)
+		addCount(report.Templates, key.template, n)
+		addCount(report.Levels, key.level, n)
+	}
+
+	removedTopics := removedConfigs()
+	isRemoved := make(map[string]bool, len(removedTopics))
+	for _, topicConfig := range removedTopics {
+		isRemoved[topicConfig.statsName()] = true
+		if sink := report.Sinks["kafka "+topicConfig.statsName()]; sink != nil {
+			sink.Removed = true
+		}
+	}
+
+	for _, topicConfig := range append(allTopicConfigs(gens), removedTopics...) {
+		topic := topicConfig.statsName()
+		rate := &rateReport{Target: float64(control.logsPerMin(topicConfig)) / 60, Removed: isRemoved[topic]}
+		if !generating.IsZero() {
+			rate.MeasuredSeconds = end.Sub(generating).Seconds()
+			if report.Generated[topic] != nil {
+				rate.Actual = float64(report.Generated[topic].Records) / rate.MeasuredSeconds
+			}
+		}
+		if rate.Target > 0 {
+			rate.Adherence = rate.Actual / rate.Target
+		}
+		report.Rates[topic] = rate
+	}
+
+	if len(gens) > 1 || gens[0].name != "" {
+		report.Definitions = make(map[string]*definitionReport, len(gens))
+		for _, g := range gens {
+			def := &definitionReport{ConfigDigest: configDigest(g.config), Topics: []string{}, Generated: &countReport{}}
+			topicConfigs := append([]*Config(nil), g.configs...)
+			for _, topicConfig := range removedTopics {
+				if topicConfig.definition == g.name {
+					topicConfigs = append(topicConfigs, topicConfig)
+					def.RemovedTopics = append(def.RemovedTopics, topicConfig.statsName())
+				}
+			}
+			for _, topicConfig := range topicConfigs {
+				topic := topicConfig.statsName()
+				if !isRemoved[topic] {
+					def.Topics = append(def.Topics, topic)
+				}
+				if n := report.Generated[topic]; n != nil {
+					def.Generated.Records += n.Records
+					def.Generated.Bytes += n.Bytes
+				}
+				if sink := report.Sinks["kafka "+topic]; sink != nil {
+					def.Sent += sink.Sent
+					def.Failed += sink.Failed
+					def.Dropped += sink.Dropped
+				}
+			}
+			report.Definitions[g.name] = def
+		}
+	}
+	return report
+}
+
+// inDefinition tells whether the sink called sinkName, "<kind> <target>",
+// belongs to the definition name, its target being prefixed by the name.
+func inDefinition(sinkName string, name string) bool {
+	i := strings.Index(sinkName, " ")
+	return i >= 0 && strings.HasPrefix(sinkName[i+1:], name+"/")
+}
+
+// forDefinition returns the part of the report about the topics of the
+// definition name, all of it for a single config.
+func (report *runReport) forDefinition(name string) *runReport {
+	if name == "" {
+		return report
+	}
+	sub := *report
+	sub.Sinks = make(map[string]*sinkReport)
+	for sinkName, sink := range report.Sinks {
+		if inDefinition(sinkName, name) {
+			sub.Sinks[sinkName] = sink
+		}
+	}
+	sub.Rates = make(map[string]*rateReport)
+	for topic, rate := range report.Rates {
+		if strings.HasPrefix(topic, name+"/") {
+			sub.Rates[topic] = rate
+		}
+	}
+	return &sub
+}
+
+// writeReport writes the report as indented JSON to path.
+func writeReport(path string, report *runReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestInDefinition(t *testing.T) {
+	tests := []struct {
+		sink string
+		want bool
+	}{
+		{"kafka billing/a", true},
+		{"kafka billing-eu/a", false},
+		{"kafka shop/billing/a", false},
+		{"file billing/log.txt", true},
+		{"kafka a", false},
+		{"billing/a", false},
+	}
+	for _, tt := range tests {
+		if got := inDefinition(tt.sink, "billing"); got != tt.want {
+			t.Errorf("inDefinition(%q, billing) = %v, want %v", tt.sink, got, tt.want)
+		}
+	}
+}
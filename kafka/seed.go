@@ -0,0 +1,65 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// workerSeed derives the seed of one worker for one round from the run seed,
+// so every worker draws its own sequence and a run can be replayed from the
+// run seed alone. The mixing is the splitmix64 finalizer.
+func workerSeed(seed int64, worker int, round int) int64 {
+	z := uint64(seed) + uint64(worker)*0x9e3779b97f4a7c15 + uint64(round)*0xd1b54a32d192ed03
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
+}
+
+// definitionSeed derives the run seed of a definition from the run seed and
+// the definition name, so a definition replays the same records whichever
+// definitions run along with it. A single config uses the run seed.
+func definitionSeed(seed int64, name string) int64 {
+	if name == "" {
+		return seed
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return workerSeed(seed^int64(h.Sum64()), 0, 0)
+}
+
+// defaultSeed is the run seed used when none is given.
+func defaultSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// seedFlag is the -seed flag. Every int64, 0 included, is a seed that can be
+// replayed, a new one is drawn only when the flag is not set.
+type seedFlag struct {
+	seed int64
+	set  bool
+}
+
+func (f *seedFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return strconv.FormatInt(f.seed, 10)
+}
+
+func (f *seedFlag) Set(s string) error {
+	seed, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return err
+	}
+	f.seed, f.set = seed, true
+	return nil
+}
+
+// value returns the seed of the flag, or defaultSeed if it was not set.
+func (f *seedFlag) value() int64 {
+	if !f.set {
+		return defaultSeed()
+	}
+	return f.seed
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quiet turns off the status table and progress lines, errors and the
+// summary at the end of the run are still printed.
+var quiet bool
+
+// Request outcomes latency is broken down by. A request is an error when
+// any of its records failed.
+const (
+	outcomeOK = iota
+	outcomeError
+	outcomes
+)
+
+var outcomeNames = [outcomes]string{"ok", "error"}
+
+// latencyQuantiles are the quantiles printed for every sink and outcome,
+// next to the max.
+var latencyQuantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}, {"p99.9", 0.999},
+}
+
+// sinkStats counts the records and bytes a sink, a topic or the log file,
+// took and times its requests. All methods are safe on a nil *sinkStats, so
+// preview and bench can share the send paths without stats.
+type sinkStats struct {
+	name     string
+	sent     uint64
+	failed   uint64
+	bytes    uint64
+	inFlight int64
+	// dropped records never made it into a request
+	dropped      uint64
+	droppedBytes uint64
+
+	latency [outcomes]histogram
+	// records and uncompressed bytes per request
+	batchRecords histogram
+	batchBytes   histogram
+	// snapshots of the previous status, only used by reportStatus
+	last [outcomes]*histSnapshot
+
+	// failed and dropped records by kind of error
+	errorsMu sync.Mutex
+	errors   map[string]uint64
+
+	// sent and failed records by template file
+	templatesMu sync.Mutex
+	templates   map[string]*templateCount
+
+	// disabled sinks are skipped, set through the control API, and their
+	// records counted as dropped
+	disabled int32
+}
+
+// templateCount counts the records of a template file a sink accepted and
+// did not accept.
+type templateCount struct {
+	Sent   uint64 `json:"sent"`
+	Failed uint64 `json:"failed"`
+}
+
+// sinks are all sinks of the run in the order they were created.
+var (
+	sinksMu sync.Mutex
+	sinks   []*sinkStats
+)
+
+// fileSinkName names the sink of save_logs_onto_file, shared by all topics.
+const fileSinkName = "file jsonLogs.json"
+
+func newSinkStats(name string) *sinkStats {
+	s := &sinkStats{name: name}
+	sinksMu.Lock()
+	sinks = append(sinks, s)
+	sinksMu.Unlock()
+	return s
+}
+
+// fileSink returns the sink of save_logs_onto_file, creating it on first use.
+func fileSink() *sinkStats {
+	return sinkNamed(fileSinkName)
+}
+
+// sinkNamed returns the sink called name, creating it on first use, so a
+// topic a reload removed and a later one added back keeps its totals.
+func sinkNamed(name string) *sinkStats {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	for _, s := range sinks {
+		if s.name == name {
+			return s
+		}
+	}
+	s := &sinkStats{name: name}
+	sinks = append(sinks, s)
+	return s
+}
+
+func allSinks() []*sinkStats {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	return append([]*sinkStats(nil), sinks...)
+}
+
+// begin starts timing a request.
+func (s *sinkStats) begin() time.Time {
+	if s != nil {
+		atomic.AddInt64(&s.inFlight, 1)
+	}
+	return time.Now()
+}
+
+// done ends a request of records, failed of which were not accepted, and
+// bytes uncompressed bytes started with begin.
+func (s *sinkStats) done(start time.Time, records int, failed int, bytes int) {
+	if s == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddUint64(&s.sent, uint64(records-failed))
+	atomic.AddUint64(&s.failed, uint64(failed))
+	atomic.AddUint64(&s.bytes, uint64(bytes*(records-failed)/records))
+	s.batchRecords.recordValue(uint64(records))
+	s.batchBytes.recordValue(uint64(bytes))
+
+	outcome := outcomeOK
+	if failed > 0 {
+		outcome = outcomeError
+	}
+	s.latency[outcome].record(elapsed)
+}
+
+// drop counts records that could not be sent, e.g. because the request
+// could not be built.
+func (s *sinkStats) drop(records int, bytes int) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.dropped, uint64(records))
+	atomic.AddUint64(&s.droppedBytes, uint64(bytes))
+}
+
+// fail counts records that failed or were dropped because of an error of
+// kind, e.g. "transport" or "http 503".
+func (s *sinkStats) fail(kind string, records int) {
+	if s == nil {
+		return
+	}
+	s.errorsMu.Lock()
+	if s.errors == nil {
+		s.errors = make(map[string]uint64)
+	}
+	s.errors[kind] += uint64(records)
+	s.errorsMu.Unlock()
+}
+
+// countTemplate counts records of a template file a request ended with,
+// failed of which were not accepted.
+func (s *sinkStats) countTemplate(template string, records int, failed int) {
+	if s == nil {
+		return
+	}
+	s.templatesMu.Lock()
+	if s.templates == nil {
+		s.templates = make(map[string]*templateCount)
+	}
+	c := s.templates[template]
+	if c == nil {
+		c = &templateCount{}
+		s.templates[template] = c
+	}
+	c.Sent += uint64(records - failed)
+	c.Failed += uint64(failed)
+	s.templatesMu.Unlock()
+}
+
+// templateCounts returns a copy of the counts by template file.
+func (s *sinkStats) templateCounts() map[string]templateCount {
+	s.templatesMu.Lock()
+	defer s.templatesMu.Unlock()
+	counts := make(map[string]templateCount, len(s.templates))
+	for template, c := range s.templates {
+		counts[template] = *c
+	}
+	return counts
+}
+
+// countTemplates counts the records of a request by template file, templates
+// holds the template of every record and failed tells whether record i was
+// not accepted.
+func countTemplates(s *sinkStats, templates []string, failed func(i int) bool) {
+	if s == nil {
+		return
+	}
+	type tally struct{ records, failed int }
+	tallies := make(map[string]*tally)
+	for i, template := range templates {
+		t := tallies[template]
+		if t == nil {
+			t = &tally{}
+			tallies[template] = t
+		}
+		t.records++
+		if failed(i) {
+			t.failed++
+		}
+	}
+	for template, t := range tallies {
+		s.countTemplate(template, t.records, t.failed)
+	}
+}
+
+func allRecords(int) bool { return true }
+
+func noRecords(int) bool { return false }
+
+// errorCounts returns a copy of the error counts by kind.
+func (s *sinkStats) errorCounts() map[string]uint64 {
+	s.errorsMu.Lock()
+	defer s.errorsMu.Unlock()
+	counts := make(map[string]uint64, len(s.errors))
+	for kind, n := range s.errors {
+		counts[kind] = n
+	}
+	return counts
+}
+
+// enabled tells whether records are sent to the sink.
+func (s *sinkStats) enabled() bool {
+	return s == nil || atomic.LoadInt32(&s.disabled) == 0
+}
+
+func (s *sinkStats) setEnabled(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&s.disabled, v)
+}
+
+// progressf prints progress lines unless quiet is set.
+func progressf(format string, a ...interface{}) {
+	if !quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// reportStatus prints the throughput, in-flight requests and totals of every
+// sink each interval, followed by the request latency of the interval by
+// sink and outcome, until stop is closed.
+func reportStatus(interval time.Duration, stop <-chan struct{}) {
+	type totals struct{ sent, bytes uint64 }
+	last := make(map[*sinkStats]totals)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := allSinks()
+		fmt.Printf("--- %s ---------------------------------------------------------------------------\n", time.Now().Format("15:04:05"))
+		fmt.Printf("%-28s %10s %10s %9s %12s %10s\n", "sink", "records/s", "bytes/s", "in-flight", "sent", "failed")
+		for _, s := range current {
+			now := totals{atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.bytes)}
+			before := last[s]
+			last[s] = now
+
+			fmt.Printf("%-28s %10.1f %10s %9d %12d %10d\n", s.name,
+				float64(now.sent-before.sent)/interval.Seconds(),
+				formatBytes(float64(now.bytes-before.bytes)/interval.Seconds()),
+				atomic.LoadInt64(&s.inFlight), now.sent, atomic.LoadUint64(&s.failed))
+		}
+		printLatency(current, func(s *sinkStats, outcome int) *histSnapshot {
+			snapshot := s.latency[outcome].snapshot()
+			d := snapshot.since(s.last[outcome])
+			s.last[outcome] = snapshot
+			return d
+		})
+		if sent, uncompressed := atomic.LoadUint64(&sentBytes), atomic.LoadUint64(&uncompressedBytes); sent != uncompressed {
+			fmt.Printf("compressed %d of %d bytes so far\n", sent, uncompressed)
+		}
+	}
+}
+
+// printLatency prints the latency quantiles of every sink and outcome with
+// requests in the snapshot returned by snapshot.
+func printLatency(current []*sinkStats, snapshot func(s *sinkStats, outcome int) *histSnapshot) {
+	header := false
+	for _, s := range current {
+		for outcome := 0; outcome < outcomes; outcome++ {
+			h := snapshot(s, outcome)
+			if h.total == 0 {
+				continue
+			}
+			if !header {
+				fmt.Printf("%-28s %-7s %9s", "latency", "outcome", "requests")
+				for _, q := range latencyQuantiles {
+					fmt.Printf(" %9s", q.name)
+				}
+				fmt.Printf(" %9s\n", "max")
+				header = true
+			}
+
+			fmt.Printf("%-28s %-7s %9d", s.name, outcomeNames[outcome], h.total)
+			for _, q := range latencyQuantiles {
+				fmt.Printf(" %9s", formatLatency(h.quantile(q.q)))
+			}
+			fmt.Printf(" %9s\n", formatLatency(time.Duration(h.max)))
+		}
+	}
+}
+
+// printSummary prints the totals and the request latency of the whole run.
+func printSummary(elapsed time.Duration) {
+	current := allSinks()
+	fmt.Printf("=== run summary, %s ===========================================================\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("%-28s %10s %10s %12s %10s %12s\n", "sink", "records/s", "bytes/s", "sent", "failed", "bytes")
+	for _, s := range current {
+		sent, bytes := atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.bytes)
+		fmt.Printf("%-28s %10.1f %10s %12d %10d %12d\n", s.name,
+			float64(sent)/elapsed.Seconds(), formatBytes(float64(bytes)/elapsed.Seconds()),
+			sent, atomic.LoadUint64(&s.failed), bytes)
+	}
+	printLatency(current, func(s *sinkStats, outcome int) *histSnapshot {
+		return s.latency[outcome].whole()
+	})
+}
+
+func formatBytes(b float64) string {
+	switch {
+	case b >= 1<<20:
+		return fmt.Sprintf("%.1fMB", b/(1<<20))
+	case b >= 1<<10:
+		return fmt.Sprintf("%.1fkB", b/(1<<10))
+	}
+	return fmt.Sprintf("%.0fB", b)
+}
+
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// genKey identifies a count of generated records.
+type genKey struct {
+	topic    string
+	template string
+	level    string
+}
+
+type genCount struct {
+	records uint64
+	bytes   uint64
+}
+
+// generated counts the records built from every template file by level.
+var (
+	generatedMu sync.Mutex
+	generated   = make(map[genKey]*genCount)
+)
+
+// genTally counts the records one goroutine generates. It is merged into
+// the generated counts with flush once per batch, so generating a record
+// takes no lock.
+type genTally map[genKey]*genCount
+
+// add counts a generated record of bytes encoded bytes.
+func (t genTally) add(key genKey, bytes int) {
+	c := t[key]
+	if c == nil {
+		c = &genCount{}
+		t[key] = c
+	}
+	c.records++
+	c.bytes += uint64(bytes)
+}
+
+// flush adds the tally to the generated counts and zeroes it.
+func (t genTally) flush() {
+	generatedMu.Lock()
+	for key, c := range t {
+		if c.records == 0 {
+			continue
+		}
+		g := generated[key]
+		if g == nil {
+			g = &genCount{}
+			generated[key] = g
+		}
+		g.records += c.records
+		g.bytes += c.bytes
+		*c = genCount{}
+	}
+	generatedMu.Unlock()
+}
+
+// generatedCounts returns a copy of the generated counts.
+func generatedCounts() map[genKey]genCount {
+	generatedMu.Lock()
+	defer generatedMu.Unlock()
+	counts := make(map[genKey]genCount, len(generated))
+	for key, c := range generated {
+		counts[key] = *c
+	}
+	return counts
+}
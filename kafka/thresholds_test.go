@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestMinRateAdherence(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     rateReport
+		checks   int
+		violated int
+		skipped  int
+	}{
+		{"met", rateReport{Target: 10, Actual: 9.8, Adherence: 0.98, MeasuredSeconds: 120}, 1, 0, 0},
+		{"missed", rateReport{Target: 10, Actual: 5, Adherence: 0.5, MeasuredSeconds: 120}, 1, 1, 0},
+		{"no minute started", rateReport{Target: 10}, 0, 0, 1},
+		{"part of a minute", rateReport{Target: 10, Actual: 2, Adherence: 0.2, MeasuredSeconds: 30}, 0, 0, 1},
+	}
+	thresholds := &Thresholds{MinRateAdherence: 0.95}
+	for _, tt := range tests {
+		rate := tt.rate
+		report := &runReport{Rates: map[string]*rateReport{"log-1": &rate}}
+		result := thresholds.check(report)
+		if result.Checks != tt.checks || len(result.Violations) != tt.violated || len(result.Skipped) != tt.skipped {
+			t.Errorf("%s: %d checks, violations %q, skipped %q", tt.name, result.Checks, result.Violations, result.Skipped)
+		}
+		if result.Passed != (tt.violated == 0) {
+			t.Errorf("%s: passed = %v", tt.name, result.Passed)
+		}
+	}
+}
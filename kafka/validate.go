@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// problems collects validation problems as "file:line: message" entries.
+// Warnings are about input the generator skips or ignores, they are printed
+// but do not fail the validation.
+type problems []problem
+
+type problem struct {
+	text    string
+	warning bool
+}
+
+func (p problem) String() string {
+	return p.text
+}
+
+func (p *problems) add(file string, line int, format string, args ...interface{}) {
+	*p = append(*p, problem{text: location(file, line) + fmt.Sprintf(format, args...)})
+}
+
+func (p *problems) warn(file string, line int, format string, args ...interface{}) {
+	*p = append(*p, problem{text: location(file, line) + "warning: " + fmt.Sprintf(format, args...), warning: true})
+}
+
+// failed returns the number of problems that are not warnings.
+func (p problems) failed() int {
+	n := 0
+	for _, problem := range p {
+		if !problem.warning {
+			n++
+		}
+	}
+	return n
+}
+
+func location(file string, line int) string {
+	if line > 0 {
+		return fmt.Sprintf("%s:%d: ", file, line)
+	}
+	return file + ": "
+}
+
+var knownLevels = map[string]bool{
+	"trace": true, "debug": true, "info": true, "notice": true, "warn": true,
+	"warning": true, "error": true, "critical": true, "fatal": true,
+}
+
+// placeholders are the random values a template message can use.
+var placeholders = []string{"$IP", "$INT", "$STRING", "$JAVA_STACK", "$PYTHON_STACK", "$GO_STACK"}
+
+// runValidate validates the config and template files, or every definition
+// of a definitions directory, prints every problem and returns the exit code.
+func runValidate(configPath string, templatePaths []string, o overrides) int {
+	var p problems
+	for _, path := range templatePaths {
+		validateTemplateFile(path, &p)
+	}
+	if isDefinitionsDir(configPath) {
+		paths, err := definitionFiles(configPath)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, path := range paths {
+			p = append(p, validate(path, true, templatePaths, o)...)
+		}
+	} else {
+		p = validate(configPath, false, templatePaths, o)
+	}
+	for _, problem := range p {
+		fmt.Println(problem)
+	}
+	if n := p.failed(); n > 0 {
+		fmt.Printf("%d problem(s) found\n", n)
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", configPath)
+	return 0
+}
+
+// validateFiles checks a config and the template files passed as arguments
+// the way runValidate does, name is the definition name, empty for a single
+// config.
+func validateFiles(name, configPath string, templatePaths []string, o overrides) problems {
+	var p problems
+	for _, path := range templatePaths {
+		validateTemplateFile(path, &p)
+	}
+	return append(p, validate(configPath, name != "", templatePaths, o)...)
+}
+
+// validate checks a config, the template files passed as arguments are
+// checked by runValidate. definition tells whether the config is in a
+// definitions directory, with template_files relative to the directory.
+func validate(configPath string, definition bool, templatePaths []string, o overrides) problems {
+	var p problems
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		p.add(configPath, 0, "%v", err)
+		return p
+	}
+
+	overridden, err := applyOverrides(data, o)
+	if err != nil {
+		p.add(configPath, jsonErrorLine(data, err), "%v", err)
+		return p
+	}
+
+	var config Config
+	if err := json.Unmarshal(overridden, &config); err != nil {
+		// line numbers only hold for the file as written
+		line := 0
+		if len(o) == 0 {
+			line = jsonErrorLine(data, err)
+		}
+		p.add(configPath, line, "%v", err)
+		return p
+	}
+
+	if definition {
+		resolveTemplateFiles(&config, filepath.Dir(configPath))
+	}
+
+	if config.IP == "" {
+		p.add(configPath, 0, "ip is empty")
+	}
+	if config.FlushInterval == 0 || config.FlushInterval > 60 {
+		p.add(configPath, 0, "flush_interval has to be between 1 and 60, got %d", config.FlushInterval)
+	}
+	if config.RestAPIVersion != "" && config.RestAPIVersion != "v2" && config.RestAPIVersion != "v3" {
+		p.add(configPath, 0, "rest_api_version has to be either v2 or v3, got %q", config.RestAPIVersion)
+	}
+	if err := checkCompression(config.Compression); err != nil {
+		p.add(configPath, 0, "%v", err)
+	}
+	if _, err := config.TLS.build(); err != nil {
+		p.add(configPath, 0, "tls: %v", err)
+	}
+	if err := config.Thresholds.validate(); err != nil {
+		p.add(configPath, 0, "%v", err)
+	}
+	if len(config.KafkaTopics) == 0 {
+		p.add(configPath, 0, "kafka_topics is empty")
+	}
+
+	for _, path := range config.TemplateFiles {
+		validateTemplateFile(path, &p)
+	}
+
+	fields := map[string]bool{"level": true, "time": true, "message": true}
+	for key := range config.Tags {
+		fields[key] = true
+	}
+	if config.SendLargeJsonLogs == "true" {
+		for key := range config.ExtraTags {
+			fields[key] = true
+		}
+	}
+
+	for i, topic := range config.KafkaTopics {
+		name := topic.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			p.add(configPath, 0, "kafka_topics entry %s has no name", name)
+		}
+		for _, other := range config.KafkaTopics[:i] {
+			if other.Name == name {
+				p.add(configPath, 0, "topic %s is in kafka_topics more than once", name)
+				break
+			}
+		}
+
+		topicConfig := config.forTopic(topic)
+		topicFields := fields
+		if len(topic.Tags) > 0 {
+			topicFields = make(map[string]bool, len(fields)+len(topic.Tags))
+			for key := range fields {
+				topicFields[key] = true
+			}
+			for key := range topic.Tags {
+				topicFields[key] = true
+			}
+		}
+
+		if topicConfig.LogsPerMin == 0 {
+			p.add(configPath, 0, "topic %s: logs_per_min is 0, nothing would be sent", name)
+		}
+		if topicConfig.MaxBulkCount == 0 {
+			p.add(configPath, 0, "topic %s: max_bulk_count is 0", name)
+		} else if topicConfig.MaxBulkCount > topicConfig.LogsPerMin {
+			p.add(configPath, 0, "topic %s: max_bulk_count %d is greater than logs_per_min %d", name, topicConfig.MaxBulkCount, topicConfig.LogsPerMin)
+		}
+		if topicConfig.Partition != nil && *topicConfig.Partition < 0 {
+			p.add(configPath, 0, "topic %s: partition can not be negative", name)
+		}
+		if len(topicConfig.Headers) > 0 && topicConfig.RestAPIVersion != "v3" {
+			p.warn(configPath, 0, "topic %s: headers are ignored, they are only sent with rest_api_version v3", name)
+		}
+
+		for _, field := range undefinedFields(topicConfig.RecordKey, topicFields) {
+			p.add(configPath, 0, "topic %s: record_key refers to undefined field ${%s}", name, field)
+		}
+		for _, header := range sortedKeys(topicConfig.Headers) {
+			for _, field := range undefinedFields(topicConfig.Headers[header], topicFields) {
+				p.add(configPath, 0, "topic %s: header %s refers to undefined field ${%s}", name, header, field)
+			}
+		}
+
+		for _, path := range topic.TemplateFiles {
+			validateTemplateFile(path, &p)
+		}
+		if len(topic.TemplateFiles) == 0 && len(templatePaths) == 0 && len(config.TemplateFiles) == 0 {
+			p.add(configPath, 0, "topic %s: no template files, pass them as arguments or set template_files", name)
+		}
+	}
+
+	return p
+}
+
+// jsonErrorLine returns the line of a JSON decoding error, or 0 if the error
+// carries no offset.
+func jsonErrorLine(data []byte, err error) int {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return 0
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return strings.Count(string(data[:offset]), "\n") + 1
+}
+
+// validateTemplateFile checks every line of a template file has the form
+// "level = <level>, message = <message>", or continues the message of the
+// template above it, and only uses known placeholders.
+func validateTemplateFile(path string, p *problems) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		p.add(path, 0, "%v", err)
+		return
+	}
+
+	templates := 0
+	continuing := false
+	for i, line := range strings.Split(string(data), "\n") {
+		if text, ok := continuation(line); ok {
+			if !continuing {
+				p.add(path, i+1, "indented line continues a message but there is no template line above it")
+			}
+			for _, name := range unknownPlaceholders(text) {
+				p.add(path, i+1, "unknown placeholder %s, use one of %s", name, strings.Join(placeholders, ", "))
+			}
+			continue
+		}
+		continuing = false
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		comma := strings.Index(line, ",")
+		if comma == -1 {
+			p.warn(path, i+1, "no comma after the level, the line is skipped, expected \"level = <level>, message = <message>\"")
+			continue
+		}
+		templates++
+		continuing = true
+
+		level := strings.SplitN(line[:comma], "=", 2)
+		if len(level) != 2 || !strings.EqualFold(strings.TrimSpace(level[0]), "level") {
+			p.add(path, i+1, "bad level syntax %q, expected \"level = <level>\"", line[:comma])
+		} else if value := strings.TrimSpace(level[1]); !knownLevels[strings.ToLower(value)] {
+			p.add(path, i+1, "unknown level %q", value)
+		}
+
+		message := strings.SplitN(line[comma+1:], "=", 2)
+		if len(message) != 2 || !strings.EqualFold(strings.TrimSpace(message[0]), "message") {
+			p.add(path, i+1, "bad message syntax, expected \"message = <message>\" after the level")
+			continue
+		}
+
+		if strings.Contains(message[1], "${") {
+			p.add(path, i+1, "${field} references are only supported in record_key and headers")
+		}
+		for _, name := range unknownPlaceholders(message[1]) {
+			p.add(path, i+1, "unknown placeholder %s, use one of %s", name, strings.Join(placeholders, ", "))
+		}
+	}
+
+	if templates == 0 {
+		p.add(path, 0, "no log templates")
+	}
+}
+
+// unknownPlaceholders returns the $NAME tokens of a message that do not
+// start with a known placeholder. Placeholders are replaced wherever they
+// occur, so "$INTseconds" is $INT followed by "seconds".
+func unknownPlaceholders(message string) []string {
+	var unknown []string
+	for i := 0; i < len(message); i++ {
+		if message[i] != '$' || i+1 == len(message) || !isIdentByte(message[i+1]) {
+			continue
+		}
+
+		known := false
+		for _, placeholder := range placeholders {
+			if strings.HasPrefix(message[i:], placeholder) {
+				known = true
+				break
+			}
+		}
+
+		end := i + 1
+		for end < len(message) && isIdentByte(message[end]) {
+			end++
+		}
+		if !known && (message[i+1] < '0' || message[i+1] > '9') {
+			unknown = append(unknown, message[i:end])
+		}
+		i = end - 1
+	}
+	return unknown
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// undefinedFields returns the ${field} references of an expression that are
+// not fields of the generated records.
+func undefinedFields(expr string, fields map[string]bool) []string {
+	var undefined []string
+	for {
+		start := strings.Index(expr, "${")
+		if start == -1 {
+			return undefined
+		}
+		end := strings.Index(expr[start:], "}")
+		if end == -1 {
+			return append(undefined, expr[start+2:])
+		}
+		end += start
+
+		if field := expr[start+2 : end]; !fields[field] {
+			undefined = append(undefined, field)
+		}
+		expr = expr[end+1:]
+	}
+}
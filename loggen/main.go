@@ -0,0 +1,183 @@
+// loggen is the single entry point of the log generators: it tells the sink
+// of a command from its config, or from -sink, and runs the command with the
+// generator of that sink, loggen-kafka or loggen-es.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// envPrefix is the prefix of the environment variables flags fall back to.
+const envPrefix = "LOGGEN_"
+
+// generators are the binaries generating logs for every sink.
+var generators = map[string]string{
+	"kafka": "loggen-kafka",
+	"es":    "loggen-es",
+}
+
+// commands are the commands of the generators, keygen is only needed by
+// the es_key of the es sink.
+var commands = []struct {
+	name    string
+	summary string
+}{
+	{"run", "Generate logs and send them to the sink of the config"},
+	{"validate", "Check the config and template files and report every problem"},
+	{"preview", "Print the first records in the wire format of the sink instead of sending"},
+	{"bench", "Benchmark record generation and request encoding"},
+	{"coordinate", "Split a run across worker processes and report on the whole run"},
+	{"worker", "Join a coordinator and run its share of the run, needs -sink"},
+	{"keygen", "Create an encrypted SnappyFlow key for es_key"},
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// runCLI replaces the process with the generator of the sink of args, so
+// signals and SIGHUP reloads reach the generator itself.
+func runCLI(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return 0
+	}
+
+	sink, args, err := findSink(args)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	binary, err := findGenerator(generators[sink])
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	err = syscall.Exec(binary, append([]string{binary}, args...), os.Environ())
+	fmt.Println(err)
+	return 1
+}
+
+func printUsage() {
+	fmt.Println("Usage: loggen [-sink kafka|es] <command> [flags] config.json|definitions/ [logTemp ...]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, c := range commands {
+		fmt.Printf("  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Println()
+	fmt.Println("The sink is told from the config, kafka_topics for kafka and es_target or es_send for es,")
+	fmt.Printf("-sink or %sSINK set it for commands without a config. The command runs with loggen-kafka\n", envPrefix)
+	fmt.Println("or loggen-es, found next to loggen or in the PATH. Run \"loggen <command> -help config.json\"")
+	fmt.Println("for the flags of a command.")
+}
+
+// findSink returns the sink of the command and args without -sink. The
+// sink is -sink, LOGGEN_SINK, es for keygen, or the sink of the first config
+// file or definitions directory in args or LOGGEN_CONFIG.
+func findSink(args []string) (string, []string, error) {
+	sink := os.Getenv(envPrefix + "SINK")
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-sink" || arg == "--sink":
+			if i+1 == len(args) {
+				return "", nil, errors.New("-sink needs a value, kafka or es")
+			}
+			sink = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-sink=") || strings.HasPrefix(arg, "--sink="):
+			sink = arg[strings.Index(arg, "=")+1:]
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	if sink == "" && len(rest) > 0 && rest[0] == "keygen" {
+		sink = "es"
+	}
+	if sink == "" {
+		paths := rest
+		if config := os.Getenv(envPrefix + "CONFIG"); config != "" {
+			paths = append(paths, config)
+		}
+		for _, path := range paths {
+			if sink = configSink(path); sink != "" {
+				break
+			}
+		}
+	}
+	if sink == "" {
+		return "", nil, errors.New("cannot tell the sink from the arguments, pass a config or -sink kafka|es")
+	}
+	if _, ok := generators[sink]; !ok {
+		return "", nil, fmt.Errorf("unknown sink %q, has to be either kafka or es", sink)
+	}
+	return sink, rest, nil
+}
+
+// configSink returns the sink of the config in path, or of the first
+// definition of a definitions directory, and an empty string if path is not
+// a config.
+func configSink(path string) string {
+	if strings.HasPrefix(path, "-") {
+		return ""
+	}
+	if info, err := os.Stat(path); err != nil {
+		return ""
+	} else if info.IsDir() {
+		paths, _ := filepath.Glob(filepath.Join(path, "*.json"))
+		if len(paths) == 0 {
+			return ""
+		}
+		path = paths[0]
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return ""
+	}
+	if _, ok := fields["kafka_topics"]; ok {
+		return "kafka"
+	}
+	for _, key := range []string{"es_target", "es_send"} {
+		if _, ok := fields[key]; ok {
+			return "es"
+		}
+	}
+	return ""
+}
+
+// findGenerator returns the path of the generator binary name, next to
+// loggen or in the PATH.
+func findGenerator(name string) (string, error) {
+	if self, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(self), name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s is not installed next to loggen or in the PATH, build it from its directory", name)
+	}
+	return path, nil
+}
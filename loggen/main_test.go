@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loggen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kafka := filepath.Join(dir, "kafka.json")
+	ioutil.WriteFile(kafka, []byte(`{"ip": "http://127.0.0.1", "kafka_topics": ["t1"]}`), 0644)
+	es := filepath.Join(dir, "es.json")
+	ioutil.WriteFile(es, []byte(`{"es_send": true}`), 0644)
+	defs := filepath.Join(dir, "defs")
+	os.Mkdir(defs, 0755)
+	ioutil.WriteFile(filepath.Join(defs, "billing.json"), []byte(`{"es_target": {}}`), 0644)
+	os.Unsetenv(envPrefix + "SINK")
+	os.Unsetenv(envPrefix + "CONFIG")
+
+	tests := []struct {
+		args []string
+		sink string
+		rest []string
+	}{
+		{[]string{"run", "-duration", "1m", kafka, "logTemp1"}, "kafka", []string{"run", "-duration", "1m", kafka, "logTemp1"}},
+		{[]string{kafka, "logTemp1"}, "kafka", []string{kafka, "logTemp1"}},
+		{[]string{"validate", es}, "es", []string{"validate", es}},
+		{[]string{"preview", defs}, "es", []string{"preview", defs}},
+		{[]string{"-sink", "kafka", "worker", "-coordinator", "127.0.0.1:9102"}, "kafka", []string{"worker", "-coordinator", "127.0.0.1:9102"}},
+		{[]string{"worker", "-sink=es"}, "es", []string{"worker"}},
+		{[]string{"keygen", "-host", "es.example.com"}, "es", []string{"keygen", "-host", "es.example.com"}},
+		{[]string{"-sink", "kafka", "run", es}, "kafka", []string{"run", es}},
+	}
+	for _, test := range tests {
+		sink, rest, err := findSink(test.args)
+		if err != nil {
+			t.Errorf("findSink(%v): %v", test.args, err)
+			continue
+		}
+		if sink != test.sink || !reflect.DeepEqual(rest, test.rest) {
+			t.Errorf("findSink(%v) = %s %v, want %s %v", test.args, sink, rest, test.sink, test.rest)
+		}
+	}
+
+	for _, args := range [][]string{{"worker"}, {"run", "-sink", "file", kafka}, {"run", "-sink"}} {
+		if _, _, err := findSink(args); err == nil {
+			t.Errorf("findSink(%v) found a sink", args)
+		}
+	}
+}